@@ -1,19 +1,22 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-
+	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/akamensky/argparse"
 	"github.com/bmatcuk/doublestar/v4"
 	"github.com/d-Rickyy-b/backmeup/internal/archiver"
+	"github.com/d-Rickyy-b/backmeup/internal/bkperrors"
 	"github.com/d-Rickyy-b/backmeup/internal/config"
 )
 
@@ -22,6 +25,12 @@ var (
 	DEBUG   bool
 )
 
+// maxSymlinkDepth is the maximum number of nested directory symlinks followed during a backup
+const maxSymlinkDepth = 40
+
+// specialFileTypes are the file types handled by the special_files option
+const specialFileTypes = fs.ModeNamedPipe | fs.ModeSocket | fs.ModeDevice | fs.ModeCharDevice
+
 var (
 	version = "dev"
 	date    = "unknown"
@@ -72,8 +81,6 @@ func handleExcludes(filePath string, excludePatterns []string) bool {
 
 // getFiles returns all file paths recursively within a certain source directory
 func getFiles(sourcePath string, unit config.Unit) ([]archiver.BackupFileMetadata, error) {
-	var pathsToBackup []archiver.BackupFileMetadata
-
 	_, statErr := os.Stat(sourcePath)
 	if statErr != nil {
 		if os.IsNotExist(statErr) {
@@ -84,13 +91,67 @@ func getFiles(sourcePath string, unit config.Unit) ([]archiver.BackupFileMetadat
 	}
 
 	// Recursively check directories for files. Add all that do not match the exclusion filters
-	err := filepath.WalkDir(sourcePath,
+	walker := &fileWalker{sourcePath: sourcePath, unit: unit}
+
+	err := walker.walkDirectory(sourcePath, 0)
+	if err != nil {
+		log.Println(err)
+	}
+
+	if len(walker.skippedSpecialFiles) > 0 {
+		log.Printf("Skipped %d special files in '%s':", len(walker.skippedSpecialFiles), sourcePath)
+
+		for _, path := range walker.skippedSpecialFiles {
+			log.Printf("  %s", path)
+		}
+	}
+
+	pathsToBackup := walker.pathsToBackup
+	if unit.Directories == "empty" {
+		pathsToBackup = removeNonEmptyDirectories(pathsToBackup)
+	}
+
+	return pathsToBackup, err
+}
+
+// removeNonEmptyDirectories removes all directories which contain at least one other entry
+func removeNonEmptyDirectories(paths []archiver.BackupFileMetadata) []archiver.BackupFileMetadata {
+	nonEmpty := make(map[string]bool)
+	for _, fileMetadata := range paths {
+		nonEmpty[filepath.Dir(fileMetadata.Path)] = true
+	}
+
+	filtered := paths[:0]
+
+	for _, fileMetadata := range paths {
+		if fileMetadata.IsDir && nonEmpty[fileMetadata.Path] {
+			continue
+		}
+
+		filtered = append(filtered, fileMetadata)
+	}
+
+	return filtered
+}
+
+// fileWalker collects the files of a single source directory
+type fileWalker struct {
+	sourcePath          string
+	unit                config.Unit
+	pathsToBackup       []archiver.BackupFileMetadata
+	skippedSpecialFiles []string
+}
+
+// walkDirectory adds all files within the given directory to pathsToBackup. If the unit follows symlinks,
+// symlinked directories are traversed as well. linkDepth is the number of symlinks followed to get there.
+func (w *fileWalker) walkDirectory(dirPath string, linkDepth int) error {
+	return filepath.WalkDir(dirPath,
 		func(path string, info fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
 
-			isExcluded := handleExcludes(path, unit.Excludes)
+			isExcluded := handleExcludes(path, w.unit.Excludes)
 			if isExcluded && !info.IsDir() {
 				return nil
 			} else if isExcluded && info.IsDir() {
@@ -98,22 +159,86 @@ func getFiles(sourcePath string, unit config.Unit) ([]archiver.BackupFileMetadat
 			}
 
 			if info.IsDir() {
+				if w.unit.Directories == "empty" || w.unit.Directories == "all" {
+					w.addPath(filepath.Clean(path), true)
+				}
+
+				return nil
+			}
+
+			fileType := info.Type()
+
+			if w.unit.FollowSymlinks && fileType&fs.ModeSymlink != 0 {
+				targetInfo, statErr := os.Stat(path)
+				if statErr == nil && targetInfo.IsDir() {
+					return w.followDirectoryLink(path, targetInfo, linkDepth)
+				} else if statErr == nil {
+					fileType = targetInfo.Mode().Type()
+				}
+			}
+
+			// Irregular files, like Windows reparse points, can't be stored in any way, whatever the special_files policy
+			if fileType&fs.ModeIrregular != 0 {
+				log.Printf("Warning: skipping irregular file '%s'", path)
 				return nil
 			}
 
-			fileMetadata := archiver.BackupFileMetadata{
-				Path:           path,
-				BackupBasePath: sourcePath,
+			if fileType&specialFileTypes != 0 {
+				return w.handleSpecialFile(path, fileType)
 			}
-			pathsToBackup = append(pathsToBackup, fileMetadata)
+
+			w.addPath(path, false)
 
 			return nil
 		})
-	if err != nil {
-		log.Println(err)
+}
+
+// addPath adds a path to the files to back up
+func (w *fileWalker) addPath(path string, isDir bool) {
+	w.pathsToBackup = append(w.pathsToBackup, archiver.BackupFileMetadata{
+		Path:           path,
+		BackupBasePath: w.sourcePath,
+		IsDir:          isDir,
+	})
+}
+
+// handleSpecialFile applies the special_files policy of the unit to a FIFO, socket or device file
+func (w *fileWalker) handleSpecialFile(path string, fileType fs.FileMode) error {
+	switch {
+	case w.unit.SpecialFiles == "fail":
+		return fmt.Errorf("%w: '%s'", bkperrors.ErrSpecialFile, path)
+	case w.unit.SpecialFiles == "header" && fileType&fs.ModeSocket == 0:
+		w.addPath(path, false)
+	default:
+		// Sockets can't be stored in archives, so they are always skipped
+		w.skippedSpecialFiles = append(w.skippedSpecialFiles, path)
 	}
 
-	return pathsToBackup, err
+	return nil
+}
+
+// followDirectoryLink walks the directory a symlink points to, unless the link creates a loop
+// or the maximum number of nested symlinks is reached
+func (w *fileWalker) followDirectoryLink(linkPath string, targetInfo fs.FileInfo, linkDepth int) error {
+	if linkDepth >= maxSymlinkDepth {
+		log.Printf("Not following symlink '%s', the maximum depth of %d nested symlinks is reached", linkPath, maxSymlinkDepth)
+		return nil
+	}
+
+	// A link pointing to one of its own parent directories would be followed forever
+	for dir := filepath.Dir(linkPath); ; dir = filepath.Dir(dir) {
+		if dirInfo, err := os.Stat(dir); err == nil && os.SameFile(dirInfo, targetInfo) {
+			log.Printf("Not following symlink '%s', it creates a loop with '%s'", linkPath, dir)
+			return nil
+		}
+
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	// The trailing separator makes WalkDir resolve the symlink instead of returning the link itself
+	return w.walkDirectory(linkPath+string(filepath.Separator), linkDepth+1)
 }
 
 // validatePath checks if a certain file/directory exists
@@ -134,10 +259,10 @@ func validatePath(path string, mustBeDir bool) bool {
 	return true
 }
 
-// writeBackup writes the files defined by the config into the defined archive format
-func writeBackup(filesToBackup []archiver.BackupFileMetadata, unit config.Unit, dryRun bool) {
+// newArchivePath returns an unused path for a new archive of the given unit
+func newArchivePath(unit config.Unit) string {
 	now := time.Now()
-	timeStamp := now.Format("2006-01-02_15-04")
+	timeStamp := now.Format(archiver.TimestampLayout)
 	backupBasePath := unit.Destination
 
 	if unit.AddSubfolder {
@@ -160,52 +285,89 @@ func writeBackup(filesToBackup []archiver.BackupFileMetadata, unit config.Unit,
 	backupExists := true
 	var backupArchiveName, backupArchivePath string
 
+	// Mirror snapshots are directories and have no file extension
+	extension := "." + unit.ArchiveType
+	if unit.ArchiveType == archiver.MirrorArchiveType {
+		extension = ""
+	} else if unit.Encryption == "age" {
+		extension += archiver.AgeExtension
+	}
+
 	for backupExists {
 		if counter == 0 {
-			backupArchiveName = fmt.Sprintf("%s-%s.%s", unit.Name, timeStamp, unit.ArchiveType)
+			backupArchiveName = fmt.Sprintf("%s-%s%s", unit.Name, timeStamp, extension)
 		} else {
-			backupArchiveName = fmt.Sprintf("%s-%s-%d.%s", unit.Name, timeStamp, counter, unit.ArchiveType)
+			backupArchiveName = fmt.Sprintf("%s-%s-%d%s", unit.Name, timeStamp, counter, extension)
 		}
 
 		backupArchivePath = filepath.Join(backupBasePath, backupArchiveName)
 
-		if _, err := os.Stat(backupArchivePath); err == nil {
+		// Archives split into volumes count as existing as well
+		if archiver.ArchiveExists(backupArchivePath) {
 			// Archive already exists
 			counter += 1
 			continue
-		} else if os.IsNotExist(err) {
-			// Archive does not exist
-			backupExists = false
 		}
 
+		backupExists = false
+
 		if counter >= 100 {
 			log.Panic("Can't find unused name for archive file! Aborting!")
 		}
 	}
 
+	return backupArchivePath
+}
+
+// writeBackup writes the files defined by the config into the defined archive format
+func writeBackup(filesToBackup []archiver.BackupFileMetadata, unit config.Unit, dryRun bool) error {
+	streaming := unit.Destination == config.StdoutDestination
+	backupArchivePath := config.StdoutDestination
+
+	if !streaming {
+		backupArchivePath = newArchivePath(unit)
+	}
+
 	if dryRun {
 		fileList := make([]string, len(filesToBackup))
 		for i, file := range filesToBackup {
 			fileList[i] = file.Path
 		}
 
-		log.Printf("[dry-run] Would create archive at '%s'\n", backupArchivePath)
+		if streaming {
+			log.Println("[dry-run] Would stream archive to stdout")
+		} else {
+			log.Printf("[dry-run] Would create archive at '%s'\n", backupArchivePath)
+		}
+
 		log.Printf("[dry-run] Archive contains the following files:\n%s\n", strings.Join(fileList, "\n"))
+		if unit.ArchiveType != archiver.MirrorArchiveType {
+			logEntryOrderRatios(filesToBackup, unit)
+		}
 		log.Println("[dry-run] Exiting now")
 
-		return
+		return nil
+	}
+	if err := archiver.WriteArchive(backupArchivePath, filesToBackup, unit); err != nil {
+		return fmt.Errorf("creating archive '%s': %w", backupArchivePath, err)
+	}
+
+	if streaming {
+		log.Println("Archive streamed to stdout successfully")
+	} else {
+		log.Printf("Archive created successfully at '%s'", backupArchivePath)
 	}
-	archiver.WriteArchive(backupArchivePath, filesToBackup, unit)
-	log.Printf("Archive created successfully at '%s'", backupArchivePath)
+
+	return nil
 }
 
 // backupUnit runs the backup for a given unit defined in the given config.yml
-func backupUnit(unit config.Unit, dryRun bool) {
+func backupUnit(unit config.Unit, dryRun bool) error {
 	// Start backup for a single unit. Each backup creates a single archive file
 	if !unit.Enabled {
 		log.Printf("Skipping backup for unit '%s' because it's disabled.\n", unit.Name)
 
-		return
+		return nil
 	}
 
 	log.Printf("Creating backup for unit '%s'\n", unit.Name)
@@ -231,7 +393,11 @@ func backupUnit(unit config.Unit, dryRun bool) {
 		processedSources = append(processedSources, sourcePath)
 
 		files, err := getFiles(sourcePath, unit)
-		if err != nil {
+		if errors.Is(err, bkperrors.ErrSpecialFile) {
+			log.Printf("Unit '%s' contains a special file and special_files is set to 'fail'. Creating no backup!", unit.Name)
+
+			return err
+		} else if err != nil {
 			log.Printf("Error for unit '%s' while reading directory '%s'! Skipping!", unit.Name, sourcePath)
 
 			continue
@@ -243,10 +409,38 @@ func backupUnit(unit config.Unit, dryRun bool) {
 	if len(filesToBackup) == 0 {
 		log.Printf("No files found for sources in unit '%s'. Creating no backup!", unit.Name)
 
+		return nil
+	}
+
+	filesToBackup = archiver.OrderEntries(filesToBackup, unit.EntryOrder, unit)
+
+	return writeBackup(filesToBackup, unit, dryRun)
+}
+
+// logEntryOrderRatios logs the compression ratio each entry order achieves on a sample of the files
+func logEntryOrderRatios(filesToBackup []archiver.BackupFileMetadata, unit config.Unit) {
+	ratios, err := archiver.CompareEntryOrders(filesToBackup, unit)
+	if err != nil {
+		log.Printf("[dry-run] Can't compare entry orders: %s", err)
+
 		return
 	}
 
-	writeBackup(filesToBackup, unit, dryRun)
+	orders := make([]string, 0, len(ratios))
+	for order := range ratios {
+		orders = append(orders, order)
+	}
+
+	sort.Strings(orders)
+
+	for _, order := range orders {
+		marker := ""
+		if order == unit.EntryOrder {
+			marker = " (configured)"
+		}
+
+		log.Printf("[dry-run] Compression ratio of a sample with entry_order '%s': %.1f%%%s", order, ratios[order]*100, marker)
+	}
 }
 
 // isUnitInList checks if the name of a unit is in a given string slice
@@ -260,8 +454,26 @@ func isUnitInList(unit config.Unit, unitNames []string) bool {
 	return false
 }
 
-// runBackup runs all the enabled backups defined in the given config.yml file
-func runBackup(config config.Config, unitNames []string, dryRun bool) {
+// countStreamingUnits counts the enabled units which would stream their archive to stdout
+func countStreamingUnits(units []config.Unit, unitNames []string) int {
+	streamingUnits := 0
+
+	for _, unit := range units {
+		if len(unitNames) > 0 && !isUnitInList(unit, unitNames) {
+			continue
+		}
+
+		if unit.Enabled && unit.Destination == config.StdoutDestination {
+			streamingUnits++
+		}
+	}
+
+	return streamingUnits
+}
+
+// runBackup runs all the enabled backups defined in the given config.yml file.
+// A failing unit does not stop the backup of the other units, but an error is returned afterwards.
+func runBackup(config config.Config, unitNames []string, dryRun bool) error {
 	unitCounter := 0
 	onlySpecifiedUnits := len(unitNames) > 0
 
@@ -269,6 +481,13 @@ func runBackup(config config.Config, unitNames []string, dryRun bool) {
 		log.Printf("Argument -u provided! Only running backups for given units: %s!", strings.Join(unitNames, ", "))
 	}
 
+	// Only a single archive can be streamed to stdout, because consecutive archives would corrupt each other
+	if countStreamingUnits(config.Units, unitNames) > 1 {
+		return errors.New("only a single unit can be streamed to stdout, use -u to select the unit")
+	}
+
+	var failedUnits []string
+
 	for _, unit := range config.Units {
 		// if unitNames contains no elements, no -u argument was provided
 		if onlySpecifiedUnits {
@@ -282,12 +501,22 @@ func runBackup(config config.Config, unitNames []string, dryRun bool) {
 			unitCounter++
 		}
 
-		backupUnit(unit, dryRun)
+		if err := backupUnit(unit, dryRun); err != nil {
+			log.Printf("Error while creating backup for unit '%s': %s", unit.Name, err)
+
+			failedUnits = append(failedUnits, unit.Name)
+		}
 	}
 
 	if onlySpecifiedUnits && unitCounter == 0 {
 		log.Printf("No units found with the provided names!")
 	}
+
+	if len(failedUnits) > 0 {
+		return fmt.Errorf("backup failed for units %s", strings.Join(failedUnits, ", "))
+	}
+
+	return nil
 }
 
 // testExclusion tests if a given path is excluded by the exclusion patterns given in the config file
@@ -322,18 +551,27 @@ func testExclusion(path string, config config.Config, unitNames []string) {
 }
 
 // printVersionString prints the full version string of backmeup
-func printVersionString() {
-	fmt.Printf("backmeup v%s, os: %s, arch: %s, built on %s\n\n", version, runtime.GOOS, runtime.GOARCH, date)
+func printVersionString(w io.Writer) {
+	fmt.Fprintf(w, "backmeup v%s, os: %s, arch: %s, built on %s\n\n", version, runtime.GOOS, runtime.GOARCH, date)
 }
 
 func main() {
 	parser := argparse.NewParser("backmeup", "The lightweight backup tool for the CLI")
 	parser.ExitOnHelp(true)
 	printVersion := parser.Flag("", "version", &argparse.Options{Required: false, Help: "Print out version", Default: false})
-	configPath := parser.String("c", "config", &argparse.Options{Required: true, Help: "Path to the config.yml file", Default: "config.yml"})
+	configPath := parser.String("c", "config", &argparse.Options{Required: false, Help: "Path to the config.yml file. Required unless an archive is listed, restored or repaired", Default: ""})
 	unitNames := parser.StringList("u", "unit", &argparse.Options{Required: false, Help: "Limit the units, defined in the config file, that should be backed up", Default: []string{}})
 	testPath := parser.String("t", "test-path", &argparse.Options{Required: false, Help: "A path to test against the exclude filters defined in the config", Default: ""})
 	dryRun := parser.Flag("n", "dry-run", &argparse.Options{Required: false, Help: "Run the backup in dry-run mode without actually backing up files", Default: false})
+	output := parser.String("o", "output", &argparse.Options{Required: false, Help: "Destination directory overriding the one of the units. Use - to stream the archive to stdout", Default: ""})
+	listArchive := parser.String("l", "list", &argparse.Options{Required: false, Help: "List the contents of the given archive", Default: ""})
+	restoreArchive := parser.String("r", "restore", &argparse.Options{Required: false, Help: "Restore the given archive into the target directory", Default: ""})
+	extractEntries := parser.StringList("e", "extract", &argparse.Options{Required: false, Help: "Only restore the given entries or directories of the archive. Seekable archives are read at the position of the entries", Default: []string{}})
+	repairArchive := parser.String("", "repair", &argparse.Options{Required: false, Help: "Check the given archive against its recovery file and repair corrupted blocks", Default: ""})
+	identityFiles := parser.StringList("i", "identity", &argparse.Options{Required: false, Help: "age identity file for listing and restoring encrypted archives", Default: []string{}})
+	passphraseFile := parser.String("", "passphrase-file", &argparse.Options{Required: false, Help: "File containing the passphrase or zip password for listing and restoring encrypted archives", Default: ""})
+	targetPath := parser.String("", "target", &argparse.Options{Required: false, Help: "Target directory for restoring an archive", Default: "."})
+	workers := parser.Int("w", "workers", &argparse.Options{Required: false, Help: "Number of workers used for compression, unless set by the unit itself", Default: 1})
 	verbose := parser.Flag("v", "verbose", &argparse.Options{Required: false, Help: "Enable verbose logging", Default: false})
 	debug := parser.Flag("d", "debug", &argparse.Options{Required: false, Help: "Enable debug logging", Default: false})
 
@@ -341,7 +579,7 @@ func main() {
 		// In case of error print error and print usage
 		// This can also be done by passing -h or --help flags
 		if strings.HasSuffix(err.Error(), "is required") && *printVersion {
-			printVersionString()
+			printVersionString(os.Stdout)
 			os.Exit(0)
 		}
 
@@ -352,25 +590,100 @@ func main() {
 	// We didn't get the true values of the arguments before calling parser.Parse()
 	VERBOSE = *verbose
 	DEBUG = *debug
+	archiver.DEBUG = DEBUG
+	archiver.Version = version
 
 	// When the --version argument is passed, print the full version string and exit
 	if *printVersion {
-		printVersionString()
+		printVersionString(os.Stdout)
 		os.Exit(0)
 	}
 
-	printVersionString()
+	// Everything but the archive contents goes to stderr, so that archives can be streamed to stdout
+	printVersionString(os.Stderr)
+
+	keys, err := archiver.ReadKeys(*identityFiles, *passphraseFile)
+	if err != nil {
+		log.Printf("Error while reading keys: %s", err)
+		os.Exit(1)
+	}
+
+	if *listArchive != "" {
+		if err := archiver.List(*listArchive, os.Stdout, keys); err != nil {
+			log.Printf("Error while listing archive '%s': %s", *listArchive, err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if *repairArchive != "" {
+		if err := archiver.Repair(*repairArchive); err != nil {
+			log.Printf("Error while repairing archive '%s': %s", *repairArchive, err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if *restoreArchive != "" {
+		log.Printf("Restoring archive '%s' to '%s'", *restoreArchive, *targetPath)
+
+		restore := archiver.Restore
+		if len(*extractEntries) > 0 {
+			restore = func(archivePath string, targetPath string, keys archiver.Keys) error {
+				return archiver.Extract(archivePath, targetPath, *extractEntries, keys)
+			}
+		}
+
+		if err := restore(*restoreArchive, *targetPath, keys); err != nil {
+			log.Printf("Error while restoring archive '%s': %s", *restoreArchive, err)
+			os.Exit(1)
+		}
+
+		log.Println("Archive restored successfully")
+		os.Exit(0)
+	}
+
+	if *configPath == "" {
+		fmt.Print(parser.Usage("[-c|--config] is required"))
+		os.Exit(1)
+	}
+
 	conf, err := config.ReadConfig(*configPath)
 	if err != nil {
 		log.Println("Error while parsing yaml config!")
 		os.Exit(1)
 	}
 
+	if *output != "" {
+		if err := conf.OverrideDestination(*output); err != nil {
+			log.Println("Error while overriding the destination of the units!")
+			os.Exit(1)
+		}
+	}
+
+	if *workers < 1 {
+		log.Println("The number of workers must be at least 1!")
+		os.Exit(1)
+	}
+
+	// Units without their own worker count use the global one
+	for i := range conf.Units {
+		if conf.Units[i].Workers == 0 {
+			conf.Units[i].Workers = *workers
+		}
+	}
+
 	if *testPath != "" {
 		testExclusion(*testPath, conf, *unitNames)
 		os.Exit(0)
 	}
 
 	log.Println("Starting backup...")
-	runBackup(conf, *unitNames, *dryRun)
+
+	if err := runBackup(conf, *unitNames, *dryRun); err != nil {
+		log.Printf("Error: %s", err)
+		os.Exit(1)
+	}
 }
@@ -1,7 +1,18 @@
 package main
 
 import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
 	"testing"
+
+	"github.com/d-Rickyy-b/backmeup/internal/archiver"
+	"github.com/d-Rickyy-b/backmeup/internal/bkperrors"
+	"github.com/d-Rickyy-b/backmeup/internal/config"
 )
 
 func TestHandleExcludeFileGlob(t *testing.T) {
@@ -154,3 +165,195 @@ func TestHandleExcludeDoubleWildcardMultipleChildren(t *testing.T) {
 		}
 	}
 }
+
+func TestGetFilesFollowsDirectorySymlinks(t *testing.T) {
+	rootPath := t.TempDir()
+	sourcePath := filepath.Join(rootPath, "source")
+	linkedPath := filepath.Join(rootPath, "linked")
+
+	for _, dir := range []string{filepath.Join(sourcePath, "sub"), linkedPath} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(linkedPath, "file.txt"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// One link to a directory outside of the source and one link creating a loop
+	if err := os.Symlink(linkedPath, filepath.Join(sourcePath, "sub", "linked")); err != nil {
+		t.Skipf("Can't create symlinks: %v", err)
+	}
+
+	if err := os.Symlink(sourcePath, filepath.Join(linkedPath, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := getFiles(sourcePath, config.Unit{FollowSymlinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+
+	sort.Strings(paths)
+
+	expected := []string{filepath.Join(sourcePath, "sub", "linked", "file.txt")}
+	if len(paths) != len(expected) || paths[0] != expected[0] {
+		t.Fatalf("Found files %v instead of %v", paths, expected)
+	}
+
+	// The followed link is stored as a directory entry in both archive formats
+	unit := config.Unit{
+		Name:             "test",
+		FollowSymlinks:   true,
+		Directories:      "all",
+		PathMode:         "relative_to_source",
+		CompressionLevel: config.DefaultCompressionLevel,
+		Workers:          1,
+		MemoryBudget:     1 << 20,
+		ZipMethod:        "deflate",
+	}
+
+	files, err = getFiles(sourcePath, unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, archiveType := range []string{"tar", "zip"} {
+		unit.ArchiveType = archiveType
+		archivePath := filepath.Join(t.TempDir(), "test."+archiveType)
+
+		if err := archiver.WriteArchive(archivePath, files, unit); err != nil {
+			t.Fatal(err)
+		}
+
+		entryTypes := readEntryTypes(t, archivePath)
+		if entryTypes["sub/linked/"] != tar.TypeDir || entryTypes["sub/linked/file.txt"] != tar.TypeReg {
+			t.Fatalf("Followed directory link is not stored as directory in %s archive: %v", archiveType, entryTypes)
+		}
+	}
+}
+
+// readEntryTypes returns the type of every entry in the archive
+func readEntryTypes(t *testing.T, archivePath string) map[string]byte {
+	t.Helper()
+
+	reader, err := archiver.OpenReader(archivePath, archiver.Keys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	entryTypes := make(map[string]byte)
+
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return entryTypes
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		entryTypes[header.Name] = header.Typeflag
+	}
+}
+
+func TestGetFilesEmptyDirectories(t *testing.T) {
+	sourcePath := t.TempDir()
+
+	for _, dir := range []string{"empty", "full", filepath.Join("nested", "empty")} {
+		if err := os.MkdirAll(filepath.Join(sourcePath, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(sourcePath, "full", "file.txt"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := getFiles(sourcePath, config.Unit{Directories: "empty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dirs []string
+	for _, file := range files {
+		if file.IsDir {
+			dirs = append(dirs, file.Path)
+		}
+	}
+
+	sort.Strings(dirs)
+
+	expected := []string{filepath.Join(sourcePath, "empty"), filepath.Join(sourcePath, "nested", "empty")}
+	if len(dirs) != len(expected) || dirs[0] != expected[0] || dirs[1] != expected[1] {
+		t.Fatalf("Found directories %v instead of %v", dirs, expected)
+	}
+}
+
+func TestGetFilesSpecialFiles(t *testing.T) {
+	sourcePath := t.TempDir()
+	fifoPath := filepath.Join(sourcePath, "pipe")
+
+	if err := exec.Command("mkfifo", fifoPath).Run(); err != nil {
+		t.Skipf("Can't create FIFO: %v", err)
+	}
+
+	expectedCounts := map[string]int{"skip": 0, "header": 1}
+	for policy, expectedCount := range expectedCounts {
+		files, err := getFiles(sourcePath, config.Unit{SpecialFiles: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) != expectedCount {
+			t.Fatalf("Found %d files instead of %d with policy '%s'", len(files), expectedCount, policy)
+		}
+	}
+
+	if _, err := getFiles(sourcePath, config.Unit{SpecialFiles: "fail"}); !errors.Is(err, bkperrors.ErrSpecialFile) {
+		t.Fatalf("Special file did not fail the walk: %v", err)
+	}
+}
+
+func TestRunBackupFailingUnit(t *testing.T) {
+	sourcePath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sourcePath, "a.txt"), []byte("hello world"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	destinationPath := t.TempDir()
+	configPath := filepath.Join(t.TempDir(), "config.yml")
+	configYaml := "broken:\n  sources:\n    - " + sourcePath + "\n  destination: " + destinationPath + "\n  archive_type: tar.gz\n" +
+		"working:\n  sources:\n    - " + sourcePath + "\n  destination: " + destinationPath + "\n  archive_type: tar\n"
+
+	if err := os.WriteFile(configPath, []byte(configYaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := config.ReadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The invalid compression level bypasses the validation of the config, so writing the archive fails
+	for i := range conf.Units {
+		if conf.Units[i].Name == "broken" {
+			conf.Units[i].CompressionLevel = 42
+		}
+	}
+
+	if err := runBackup(conf, nil, false); err == nil {
+		t.Fatal("Failing unit did not fail the backup")
+	}
+
+	archives, _ := filepath.Glob(filepath.Join(destinationPath, "working-*.tar"))
+	if len(archives) != 1 {
+		t.Fatalf("Unit after the failing unit created %d archives instead of 1", len(archives))
+	}
+}
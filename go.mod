@@ -3,19 +3,28 @@ module github.com/d-Rickyy-b/backmeup
 go 1.20
 
 require (
+	filippo.io/age v1.2.0
 	github.com/akamensky/argparse v1.4.0
 	github.com/bmatcuk/doublestar/v4 v4.6.1
 	github.com/cheggaaa/pb/v3 v3.1.5
+	github.com/dsnet/compress v0.0.1
 	github.com/klauspost/compress v1.17.9
+	github.com/klauspost/pgzip v1.2.6
+	github.com/klauspost/reedsolomon v1.12.1
+	github.com/mattn/go-isatty v0.0.20
+	github.com/pierrec/lz4/v4 v4.1.21
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/crypto v0.24.0
+	golang.org/x/sys v0.25.0
+	golang.org/x/term v0.21.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
 	github.com/VividCortex/ewma v1.2.0 // indirect
 	github.com/fatih/color v1.17.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
-	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
-	golang.org/x/sys v0.25.0 // indirect
 )
@@ -1,210 +1,440 @@
 package archiver
 
 import (
-	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cheggaaa/pb/v3"
+	"github.com/d-Rickyy-b/backmeup/internal/bkperrors"
 	"github.com/d-Rickyy-b/backmeup/internal/config"
-	"github.com/klauspost/compress/gzip"
-	"github.com/klauspost/compress/zip"
+	"github.com/mattn/go-isatty"
 )
 
+// DEBUG enables debug logging of the archivers
+var DEBUG bool
+
 type BackupFileMetadata struct {
 	Path           string
 	BackupBasePath string
+	IsDir          bool
+	// contentHash is set by WriteArchive for regular files, which are hashed again while they are added to detect changes
+	contentHash *contentHash
 }
 
-var currentUnitConfig config.Unit
+// Archiver writes the files of a backup unit into a single archive of a certain format
+type Archiver interface {
+	// Open prepares the archiver to write the archive into the given writer
+	Open(w io.Writer) error
+	// AddEntry adds a single file to the archive
+	AddEntry(fileMetadata BackupFileMetadata) error
+	// AddContent adds an entry with the given content, which does not exist on disk, to the archive
+	AddContent(pathInArchive string, content []byte, modTime time.Time) error
+	// Close finalizes the archive. It does not close the underlying writer.
+	Close() error
+}
 
-func getPathInArchive(filePath string, backupBasePath string) string {
-	// Remove the base Path from the file Path within the archiver, if option is set
-	pathInArchive := filePath
+// commenter is implemented by archivers whose archive format supports an archive comment
+type commenter interface {
+	// SetComment sets the comment of the archive, which is written when the archiver is closed
+	SetComment(comment string)
+}
 
-	if !currentUnitConfig.UseAbsolutePaths {
-		parentBasePath := filepath.Dir(backupBasePath)
-		pathInArchive = strings.ReplaceAll(filePath, parentBasePath, "")
+// flusher is implemented by archivers which add entries asynchronously
+type flusher interface {
+	// flush waits until all entries added so far are written to the archive
+	flush() error
+}
 
-		pathInArchive = strings.TrimPrefix(pathInArchive, "\\")
+// indexer is implemented by archivers which write seekable archives
+type indexer interface {
+	// seekIndex returns the seek index of the archive or nil, if the archive is not seekable
+	seekIndex() *seekIndex
+}
+
+// Factory creates a new Archiver for the given unit
+type Factory func(unit config.Unit) Archiver
+
+// registry maps the archive_type config value to the factory of the corresponding Archiver
+var registry = make(map[string]Factory)
+
+// Register makes an Archiver available for the given archive type.
+// The archive type also becomes a valid value for the archive_type config option.
+func Register(archiveType string, factory Factory) {
+	if _, exists := registry[archiveType]; exists {
+		log.Panicf("Archiver for archive type '%s' is already registered", archiveType)
 	}
 
-	return pathInArchive
+	registry[archiveType] = factory
+	config.RegisterArchiveType(archiveType)
 }
 
-func WriteArchive(backupArchivePath string, filesToBackup []BackupFileMetadata, unit config.Unit) {
-	// Store the current config for other methods to access config parameters
-	currentUnitConfig = unit
-	archiveFile, err := os.Create(backupArchivePath)
-	if err != nil {
-		log.Fatalln(err)
+// ArchiveTypes returns the sorted list of all registered archive types
+func ArchiveTypes() []string {
+	archiveTypes := make([]string, 0, len(registry))
+	for archiveType := range registry {
+		archiveTypes = append(archiveTypes, archiveType)
 	}
-	defer archiveFile.Close()
 
-	switch unit.ArchiveType {
-	case "tar.gz":
-		writeTar(archiveFile, filesToBackup)
-	case "zip":
-		writeZip(archiveFile, filesToBackup)
-	default:
-		log.Panicf("Can't handle archiver type '%s'", unit.ArchiveType)
+	sort.Strings(archiveTypes)
+
+	return archiveTypes
+}
+
+// New returns a new Archiver for the archive type configured in the given unit
+func New(unit config.Unit) (Archiver, error) {
+	factory, exists := registry[unit.ArchiveType]
+	if !exists {
+		return nil, fmt.Errorf("%w: '%s'", bkperrors.ErrUnknownArchiveType, unit.ArchiveType)
 	}
+
+	return factory(unit), nil
 }
 
-func writeTar(archiveFile *os.File, filesToBackup []BackupFileMetadata) {
-	// set up the gzip and tar writer
-	gw := gzip.NewWriter(archiveFile)
-	defer gw.Close()
+func init() {
+	Register("tar", newTarArchiver(newNopCompressor))
+	Register("tar.gz", newTarArchiver(newGzipCompressor))
+	Register("tar.zst", newTarArchiver(newZstdCompressor))
+	Register("tar.xz", newTarArchiver(newXzCompressor))
+	Register("tar.bz2", newTarArchiver(newBzip2Compressor))
+	Register("tar.lz4", newTarArchiver(newLz4Compressor))
+	Register("zip", newZipArchiver)
+
+	// The compression levels are checked when the config is read, so invalid levels fail before any file is read
+	config.RegisterCompressionLevels("tar.gz", 0, 9)
+	config.RegisterCompressionLevels("tar.zst", 1, 22)
+	config.RegisterCompressionLevels("tar.xz", 0, len(xzDictCaps)-1)
+	config.RegisterCompressionLevels("tar.bz2", 1, 9)
+	config.RegisterCompressionLevels("tar.lz4", 0, len(lz4Levels)-1)
+	config.RegisterCompressionLevels("zip", 0, 9)
+
+	// Snapshots are directories, so there is no Archiver writing them
+	config.RegisterArchiveType(MirrorArchiveType)
+}
 
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+// getPathInArchive returns the slash separated path of the file within the archive, as configured by the path mode
+// and the archive prefix of the source. The source directory itself has no path in relative_to_source mode.
+func getPathInArchive(filePath string, backupBasePath string, unit config.Unit) string {
+	prefix := unit.ArchivePrefixes[filepath.Clean(backupBasePath)]
 
-	// Init progress bar
-	bar := pb.New(len(filesToBackup))
-	bar.SetMaxWidth(100)
-	bar.Start()
+	basePath := ""
 
-	for i := range filesToBackup {
-		fileMetadata := filesToBackup[i]
-		filePath := fileMetadata.Path
+	switch {
+	case prefix != "" || unit.PathMode == "relative_to_source":
+		basePath = backupBasePath
+	case unit.PathMode == "relative_to_parent" || (unit.PathMode == "" && !unit.UseAbsolutePaths):
+		basePath = filepath.Dir(backupBasePath)
+	}
 
-		pathInArchive := getPathInArchive(filePath, fileMetadata.BackupBasePath)
+	pathInArchive := absolutePathInArchive(filePath)
 
-		if err := addFileToTar(tw, filePath, pathInArchive); err != nil {
-			log.Printf("Error while adding %s to the archive. %s", filePath, err)
+	if basePath != "" {
+		relPath, err := filepath.Rel(basePath, filePath)
+		if err == nil && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			pathInArchive = filepath.ToSlash(relPath)
 		}
+	}
 
-		bar.Increment()
+	if prefix != "" {
+		pathInArchive = path.Join(filepath.ToSlash(prefix), pathInArchive)
 	}
 
-	bar.Finish()
+	if pathInArchive == "." {
+		return ""
+	}
+
+	return pathInArchive
 }
 
-func writeZip(archiveFile *os.File, filesToBackup []BackupFileMetadata) {
-	zw := zip.NewWriter(archiveFile)
-	defer zw.Close()
+// absolutePathInArchive returns the absolute path of the file without volume name and leading separator,
+// because archive entries must not be absolute
+func absolutePathInArchive(filePath string) string {
+	filePath = strings.TrimPrefix(filePath, filepath.VolumeName(filePath))
 
-	bar := pb.New(len(filesToBackup))
-	bar.SetMaxWidth(100)
-	bar.Start()
+	return strings.TrimLeft(filepath.ToSlash(filePath), "/")
+}
+
+// archiveOutput is the destination an archive is written to
+type archiveOutput interface {
+	io.WriteCloser
+	// Remove deletes everything written so far
+	Remove()
+	// Checksums returns the SHA-256 checksums of the written files, once the output is closed
+	Checksums() []fileChecksum
+}
+
+// fileChecksum is the SHA-256 checksum of a single written file
+type fileChecksum struct {
+	path string
+	sum  []byte
+}
 
-	for i := range filesToBackup {
-		fileMetadata := filesToBackup[i]
-		filePath := fileMetadata.Path
+// fileOutput writes the archive into a single file
+type fileOutput struct {
+	*os.File
+	hash hash.Hash
+}
+
+func newFileOutput(file *os.File) *fileOutput {
+	return &fileOutput{File: file, hash: sha256.New()}
+}
+
+// Write hashes the archive while it is written, so it does not have to be read again
+func (f *fileOutput) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.hash.Write(p[:n])
+
+	return n, err
+}
+
+func (f *fileOutput) Remove() {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func (f *fileOutput) Checksums() []fileChecksum {
+	return []fileChecksum{{path: f.Name(), sum: f.hash.Sum(nil)}}
+}
+
+// stdoutOutput streams the archive to stdout
+type stdoutOutput struct {
+	io.Writer
+}
 
-		pathInArchive := getPathInArchive(filePath, fileMetadata.BackupBasePath)
+func (stdoutOutput) Close() error {
+	return nil
+}
+
+// Remove can't take back what was already streamed, the consumer has to discard the incomplete archive
+func (stdoutOutput) Remove() {}
+
+// Checksums returns nothing, because there is no file to verify
+func (stdoutOutput) Checksums() []fileChecksum {
+	return nil
+}
 
-		if err := addFileToZip(zw, filePath, pathInArchive); err != nil {
-			log.Printf("Error while adding %s to the archive. %s", filePath, err)
+// createOutput creates the output for a new archive, split into volumes if configured by the unit
+func createOutput(backupArchivePath string, unit config.Unit) (archiveOutput, error) {
+	if backupArchivePath == config.StdoutDestination {
+		if isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd()) {
+			return nil, errors.New("refusing to write the archive to a terminal, redirect stdout to a file or pipe")
 		}
 
-		bar.Increment()
+		return stdoutOutput{os.Stdout}, nil
 	}
 
-	bar.Finish()
-}
+	if unit.VolumeSize > 0 {
+		return newVolumeWriter(backupArchivePath, unit.VolumeSize), nil
+	}
 
-func addFileToTar(tw *tar.Writer, path string, pathInArchive string) error {
-	stat, statErr := os.Lstat(path)
-	if statErr != nil {
-		return statErr
+	archiveFile, err := os.Create(backupArchivePath)
+	if err != nil {
+		return nil, err
 	}
-	var linkTarget string
-	// Check if file is symlink
-	if stat.Mode()&os.ModeSymlink != 0 {
-		var err error
-		linkTarget, err = os.Readlink(path)
-		if err != nil {
-			return fmt.Errorf("%s: readlink: %v", stat.Name(), err)
-		}
 
-		// In case the user wants to follow symlinks we eval the symlink target
-		if currentUnitConfig.FollowSymlinks {
-			linkTargetPath, evalSymlinkErr := filepath.EvalSymlinks(path)
-			if evalSymlinkErr != nil {
-				return evalSymlinkErr
-			}
-
-			linkTargetInfo, linkTargetStatErr := os.Stat(linkTargetPath)
-			if linkTargetStatErr != nil {
-				log.Printf("Can't access link target!")
-				return linkTargetStatErr
-			}
-
-			if linkTargetInfo.Mode().IsRegular() {
-				// If file is regular, we can simply replace the symlink with the actual file
-				path = linkTargetPath
-				linkTarget = ""
-				stat = linkTargetInfo
-			} else {
-				log.Printf("Can't access link target. File is not regular!")
-				return errors.New("file is not regular")
-			}
-		}
+	return newFileOutput(archiveFile), nil
+}
+
+// WriteArchive writes all the given files into a new archive at backupArchivePath
+// or, for the mirror archive type, into a new snapshot directory at backupArchivePath
+func WriteArchive(backupArchivePath string, filesToBackup []BackupFileMetadata, unit config.Unit) error {
+	// The source directory itself has no path in the archive, if paths are relative to the source
+	filesToBackup = withPathInArchive(filesToBackup, unit)
+
+	if unit.ArchiveType == MirrorArchiveType {
+		return writeMirror(backupArchivePath, filesToBackup, unit)
 	}
 
-	file, err := os.Open(path)
+	archiver, err := New(unit)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	// now lets create the header as needed for this file within the tarball
-	header, err := tar.FileInfoHeader(stat, filepath.ToSlash(linkTarget))
+	// The order of the walk depends on the order of the sources, so reproducible archives are sorted by path.
+	// All other entry orders are deterministic already.
+	if unit.Reproducible && (unit.EntryOrder == "walk" || unit.EntryOrder == "") {
+		filesToBackup = sortedByPathInArchive(filesToBackup, unit)
+	}
+
+	manifest, err := newManifest(unit)
 	if err != nil {
 		return err
 	}
-	header.Name = pathInArchive
 
-	// write the header to the tarball archiver
-	if err := tw.WriteHeader(header); err != nil {
+	output, err := createOutput(backupArchivePath, unit)
+	if err != nil {
 		return err
 	}
 
-	// Check for regular files
-	if stat.Mode().IsRegular() {
-		// copy the file data to the tarball
-		_, err := io.Copy(tw, file)
+	// Encryption happens after compression, as encrypted data is incompressible
+	var archiveWriter io.Writer = output
+	var encryptor io.WriteCloser
+
+	if unit.Encryption == "age" {
+		encryptor, err = newEncryptor(output, unit)
 		if err != nil {
-			return fmt.Errorf("%s: copying contents: %w", file.Name(), err)
+			output.Remove()
+
+			return fmt.Errorf("setting up encryption: %w", err)
 		}
+
+		archiveWriter = encryptor
 	}
 
-	return nil
-}
+	if err := archiver.Open(archiveWriter); err != nil {
+		output.Remove()
 
-func addFileToZip(zw *zip.Writer, path string, pathInArchive string) error {
-	file, err := os.Open(path)
+		return err
+	}
+
+	// The manifest is the first entry of the archive, so all files are hashed before they are written
+	filesToBackup = manifest.addFiles(filesToBackup, unit)
+	manifest.finish(unit)
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
 	if err != nil {
+		output.Remove()
+
+		return err
+	}
+
+	manifestModTime := time.Now()
+	if unit.Reproducible {
+		manifestModTime = latestModTime(filesToBackup)
+	}
+
+	if err := archiver.AddContent(ManifestPath, manifestData, manifestModTime); err != nil {
+		output.Remove()
+
 		return err
 	}
-	defer file.Close()
 
-	if stat, err := file.Stat(); err == nil {
-		header, headerErr := zip.FileInfoHeader(stat)
-		if headerErr != nil {
-			return headerErr
+	// Init progress bar
+	bar := pb.New(len(filesToBackup))
+	bar.SetMaxWidth(100)
+	bar.Start()
+
+	for _, fileMetadata := range filesToBackup {
+		if err := archiver.AddEntry(fileMetadata); err != nil {
+			log.Printf("Error while adding %s to the archive. %s", fileMetadata.Path, err)
 		}
 
-		header.Method = zip.Deflate
-		header.Name = pathInArchive
-		// write the header to the zip archiver
-		writer, headerErr := zw.CreateHeader(header)
-		if headerErr != nil {
+		bar.Increment()
+	}
+
+	bar.Finish()
+
+	if f, ok := archiver.(flusher); ok {
+		if err := f.flush(); err != nil {
+			output.Remove()
+
 			return err
 		}
-		// copy the file data to the zip
-		if _, err := io.Copy(writer, file); err != nil {
+	}
+
+	manifest.checkFiles(filesToBackup)
+
+	if c, ok := archiver.(commenter); ok {
+		c.SetComment(manifest.Summary())
+	}
+
+	if err := archiver.Close(); err != nil {
+		output.Remove()
+
+		return err
+	}
+
+	if encryptor != nil {
+		if err := encryptor.Close(); err != nil {
+			output.Remove()
+
 			return err
 		}
-	} else {
+	}
+
+	if volumes, ok := output.(*volumeWriter); ok {
+		log.Printf("Archive was split into %d volumes", len(volumes.paths))
+	}
+
+	if err := output.Close(); err != nil {
 		return err
 	}
 
-	return nil
+	if i, ok := archiver.(indexer); ok && i.seekIndex() != nil {
+		if err := writeSeekIndex(backupArchivePath, i.seekIndex()); err != nil {
+			return err
+		}
+	}
+
+	if unit.RecoveryPercent > 0 {
+		log.Printf("Creating recovery file with %d%% redundancy", unit.RecoveryPercent)
+
+		if err := writeRecoveryFile(backupArchivePath, unit.RecoveryPercent); err != nil {
+			return fmt.Errorf("writing recovery file: %w", err)
+		}
+	}
+
+	return writeSidecarFiles(backupArchivePath, output.Checksums(), manifest, unit)
+}
+
+// withPathInArchive returns the files, which have a path within the archive
+func withPathInArchive(files []BackupFileMetadata, unit config.Unit) []BackupFileMetadata {
+	filtered := make([]BackupFileMetadata, 0, len(files))
+
+	for _, file := range files {
+		if getPathInArchive(file.Path, file.BackupBasePath, unit) != "" {
+			filtered = append(filtered, file)
+		}
+	}
+
+	return filtered
+}
+
+// sortedByPathInArchive returns a copy of the files sorted by their path within the archive
+func sortedByPathInArchive(files []BackupFileMetadata, unit config.Unit) []BackupFileMetadata {
+	sorted := append([]BackupFileMetadata(nil), files...)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return getPathInArchive(sorted[i].Path, sorted[i].BackupBasePath, unit) < getPathInArchive(sorted[j].Path, sorted[j].BackupBasePath, unit)
+	})
+
+	return sorted
+}
+
+// reproducibleModTime returns the modification time stored in reproducible archives. It is truncated to seconds
+// and clamped to SOURCE_DATE_EPOCH, if set, as proposed by https://reproducible-builds.org/specs/source-date-epoch/
+func reproducibleModTime(modTime time.Time) time.Time {
+	modTime = modTime.Truncate(time.Second)
+
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		if clamp := time.Unix(epoch, 0); modTime.After(clamp) {
+			modTime = clamp
+		}
+	}
+
+	return modTime.UTC()
+}
+
+// countingWriter counts the bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+
+	return n, err
 }
@@ -0,0 +1,1451 @@
+package archiver
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/d-Rickyy-b/backmeup/internal/bkperrors"
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+	"github.com/klauspost/compress/zip"
+)
+
+// createTestFiles creates a few files in a new source directory and returns their metadata
+func createTestFiles(t *testing.T) []BackupFileMetadata {
+	t.Helper()
+
+	sourcePath := filepath.Join(t.TempDir(), "source")
+	contents := map[string]string{
+		"a.txt":          "hello world",
+		"sub/b.log":      strings.Repeat("log line\n", 10000),
+		"sub/deep/c.csv": "1,2,3\n4,5,6\n",
+	}
+
+	var files []BackupFileMetadata
+
+	for name, content := range contents {
+		path := filepath.Join(sourcePath, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		files = append(files, BackupFileMetadata{Path: path, BackupBasePath: sourcePath})
+	}
+
+	return files
+}
+
+// testUnit returns a unit with the defaults of the config for the given archive type
+func testUnit(archiveType string) config.Unit {
+	return config.Unit{
+		Name:             "test",
+		ArchiveType:      archiveType,
+		CompressionLevel: config.DefaultCompressionLevel,
+		Workers:          1,
+		MemoryBudget:     1 << 20,
+		ZipMethod:        "deflate",
+	}
+}
+
+// readArchive reads all regular files of an archive into a map of entry name to content
+func readArchive(t *testing.T, archivePath string) map[string]string {
+	t.Helper()
+
+	reader, err := OpenReader(archivePath, Keys{})
+	if err != nil {
+		t.Fatalf("Can't open archive '%s': %v", archivePath, err)
+	}
+	defer reader.Close()
+
+	entries := make(map[string]string)
+
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return entries
+		} else if err != nil {
+			t.Fatalf("Can't read archive '%s': %v", archivePath, err)
+		}
+
+		if header.Name == ManifestPath {
+			continue
+		}
+
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Can't read entry '%s': %v", header.Name, err)
+		}
+
+		entries[header.Name] = string(content)
+	}
+}
+
+// checkArchive checks that the archive contains exactly the given files
+func checkArchive(t *testing.T, archivePath string, files []BackupFileMetadata, unit config.Unit) {
+	t.Helper()
+
+	entries := readArchive(t, archivePath)
+	if len(entries) != len(files) {
+		t.Fatalf("Archive '%s' contains %d entries instead of %d", archivePath, len(entries), len(files))
+	}
+
+	for _, file := range files {
+		expected, err := os.ReadFile(file.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name := getPathInArchive(file.Path, file.BackupBasePath, unit)
+		if entries[name] != string(expected) {
+			t.Fatalf("Content of entry '%s' in archive '%s' does not match", name, archivePath)
+		}
+	}
+}
+
+func TestWriteArchiveAllTypes(t *testing.T) {
+	files := createTestFiles(t)
+
+	for _, archiveType := range ArchiveTypes() {
+		unit := testUnit(archiveType)
+		archivePath := filepath.Join(t.TempDir(), "test."+archiveType)
+
+		if err := WriteArchive(archivePath, files, unit); err != nil {
+			t.Fatalf("Can't write archive of type '%s': %v", archiveType, err)
+		}
+
+		checkArchive(t, archivePath, files, unit)
+	}
+}
+
+func TestWriteArchiveStdout(t *testing.T) {
+	files := createTestFiles(t)
+
+	for _, archiveType := range []string{"tar.gz", "zip"} {
+		unit := testUnit(archiveType)
+		unit.Destination = config.StdoutDestination
+
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The archive is read from the pipe while it is written
+		archivePath := filepath.Join(t.TempDir(), "test."+archiveType)
+		copyErr := make(chan error, 1)
+
+		go func() {
+			archiveFile, err := os.Create(archivePath)
+			if err == nil {
+				_, err = io.Copy(archiveFile, reader)
+				archiveFile.Close()
+			}
+
+			copyErr <- err
+		}()
+
+		stdout := os.Stdout
+		os.Stdout = writer
+		writeErr := WriteArchive(config.StdoutDestination, files, unit)
+		os.Stdout = stdout
+		writer.Close()
+
+		if err := <-copyErr; err != nil {
+			t.Fatal(err)
+		}
+
+		reader.Close()
+
+		if writeErr != nil {
+			t.Fatalf("Can't write archive of type '%s' to stdout: %v", archiveType, writeErr)
+		}
+
+		checkArchive(t, archivePath, files, unit)
+	}
+}
+
+func TestWriteArchiveVolumes(t *testing.T) {
+	files := createTestFiles(t)
+
+	for _, archiveType := range []string{"tar", "zip"} {
+		unit := testUnit(archiveType)
+		unit.VolumeSize = 200
+
+		archivePath := filepath.Join(t.TempDir(), "test."+archiveType)
+		if err := WriteArchive(archivePath, files, unit); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(archivePath); !os.IsNotExist(err) {
+			t.Fatalf("Archive '%s' was not split into volumes", archivePath)
+		}
+
+		if !ArchiveExists(archivePath) {
+			t.Fatalf("Volumes of archive '%s' are not detected", archivePath)
+		}
+
+		if len(findVolumes(archivePath)) < 2 {
+			t.Fatalf("Archive '%s' has less than two volumes", archivePath)
+		}
+
+		checkArchive(t, archivePath, files, unit)
+		checkArchive(t, volumePath(archivePath, 1), files, unit)
+	}
+}
+
+func TestRestorePath(t *testing.T) {
+	paths := map[string]string{
+		"/home/test/file.png":          filepath.Join("target", "home", "test", "file.png"),
+		"relative/file.png":            filepath.Join("target", "relative", "file.png"),
+		"C:\\Users\\admin\\file.png":   filepath.Join("target", "Users", "admin", "file.png"),
+		"/home/test/../other/file.png": filepath.Join("target", "home", "other", "file.png"),
+	}
+
+	for name, expected := range paths {
+		restored, err := restorePath("target", name)
+		if err != nil {
+			t.Fatalf("Path '%s' could not be restored: %v", name, err)
+		}
+
+		if restored != expected {
+			t.Fatalf("Path '%s' was restored to '%s' instead of '%s'", name, restored, expected)
+		}
+	}
+
+	for _, name := range []string{"../escape.txt", "/../../escape.txt", "."} {
+		if _, err := restorePath("target", name); err == nil {
+			t.Fatalf("Path '%s' escapes the target directory", name)
+		}
+	}
+}
+
+func TestWriteArchiveXattrs(t *testing.T) {
+	if !xattrsSupported {
+		t.Skip("extended attributes are not supported on this platform")
+	}
+
+	files := createTestFiles(t)
+	if err := writeXattr(files[0].Path, "user.backmeup", []byte("test")); err != nil {
+		t.Skipf("file system does not support extended attributes: %v", err)
+	}
+
+	unit := testUnit("tar")
+	unit.PreserveXattrs = true
+
+	archivePath := filepath.Join(t.TempDir(), "test.tar")
+	if err := WriteArchive(archivePath, files, unit); err != nil {
+		t.Fatal(err)
+	}
+
+	targetPath := t.TempDir()
+	if err := Restore(archivePath, targetPath, Keys{}); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredPath, err := restorePath(targetPath, getPathInArchive(files[0].Path, files[0].BackupBasePath, unit))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xattrs, err := readXattrs(restoredPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(xattrs["user.backmeup"]) != "test" {
+		t.Fatalf("Extended attribute was restored as '%s' instead of 'test'", xattrs["user.backmeup"])
+	}
+}
+
+func TestRestoreSymlinkXattrs(t *testing.T) {
+	if !xattrsSupported {
+		t.Skip("extended attributes are not supported on this platform")
+	}
+
+	files := createTestFiles(t)
+
+	linkPath := filepath.Join(files[0].BackupBasePath, "link.txt")
+	if err := os.Symlink(filepath.Base(files[0].Path), linkPath); err != nil {
+		t.Skipf("Can't create symlinks: %v", err)
+	}
+
+	// Linux only allows trusted attributes on symlinks, which require root
+	var name string
+	for _, candidate := range []string{"user.backmeup", "trusted.backmeup"} {
+		if err := writeXattr(linkPath, candidate, []byte("test")); err == nil {
+			name = candidate
+			break
+		}
+	}
+
+	if name == "" {
+		t.Skip("file system does not support extended attributes on symlinks")
+	}
+
+	files = append(files, BackupFileMetadata{Path: linkPath, BackupBasePath: files[0].BackupBasePath})
+
+	unit := testUnit("tar")
+	unit.PreserveXattrs = true
+
+	archivePath := filepath.Join(t.TempDir(), "test.tar")
+	if err := WriteArchive(archivePath, files, unit); err != nil {
+		t.Fatal(err)
+	}
+
+	targetPath := t.TempDir()
+	if err := Restore(archivePath, targetPath, Keys{}); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredPath, err := restorePath(targetPath, getPathInArchive(linkPath, files[0].BackupBasePath, unit))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat, err := os.Lstat(restoredPath); err != nil || stat.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("Symlink was not restored: %v", err)
+	}
+
+	xattrs, err := readXattrs(restoredPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(xattrs[name]) != "test" {
+		t.Fatalf("Extended attribute of symlink was restored as '%s' instead of 'test'", xattrs[name])
+	}
+}
+
+func TestWriteArchiveHardLinks(t *testing.T) {
+	files := createTestFiles(t)
+
+	linkPath := filepath.Join(files[0].BackupBasePath, "link.txt")
+	if err := os.Link(files[0].Path, linkPath); err != nil {
+		t.Skipf("file system does not support hard links: %v", err)
+	}
+
+	if _, isLinked := inodeOf(mustStat(t, linkPath)); !isLinked {
+		t.Skip("hard links are not detected on this platform")
+	}
+
+	files = append(files, BackupFileMetadata{Path: linkPath, BackupBasePath: files[0].BackupBasePath})
+	unit := testUnit("tar")
+
+	archivePath := filepath.Join(t.TempDir(), "test.tar")
+	if err := WriteArchive(archivePath, files, unit); err != nil {
+		t.Fatal(err)
+	}
+
+	targetPath := t.TempDir()
+	if err := Restore(archivePath, targetPath, Keys{}); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredFile, _ := restorePath(targetPath, getPathInArchive(files[0].Path, files[0].BackupBasePath, unit))
+	restoredLink, _ := restorePath(targetPath, getPathInArchive(linkPath, files[0].BackupBasePath, unit))
+
+	if !os.SameFile(mustStat(t, restoredFile), mustStat(t, restoredLink)) {
+		t.Fatalf("Hard link '%s' was not restored as link to '%s'", restoredLink, restoredFile)
+	}
+
+	// Links to a file which is not extracted get its content, the later links link to the first one
+	secondLinkPath := filepath.Join(files[0].BackupBasePath, "second.txt")
+	if err := os.Link(files[0].Path, secondLinkPath); err != nil {
+		t.Fatal(err)
+	}
+
+	files = append(files, BackupFileMetadata{Path: secondLinkPath, BackupBasePath: files[0].BackupBasePath})
+	if err := WriteArchive(archivePath, files, unit); err != nil {
+		t.Fatal(err)
+	}
+
+	linkNames := []string{
+		getPathInArchive(linkPath, files[0].BackupBasePath, unit),
+		getPathInArchive(secondLinkPath, files[0].BackupBasePath, unit),
+	}
+
+	targetPath = t.TempDir()
+	if err := Extract(archivePath, targetPath, linkNames, Keys{}); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredFile, _ = restorePath(targetPath, getPathInArchive(files[0].Path, files[0].BackupBasePath, unit))
+	if _, err := os.Lstat(restoredFile); !os.IsNotExist(err) {
+		t.Fatalf("Linked file '%s' was extracted although it was not requested", restoredFile)
+	}
+
+	restoredLink, _ = restorePath(targetPath, linkNames[0])
+	restoredSecondLink, _ := restorePath(targetPath, linkNames[1])
+	expected, _ := os.ReadFile(files[0].Path)
+
+	if content, err := os.ReadFile(restoredLink); err != nil || !bytes.Equal(content, expected) {
+		t.Fatalf("Content of extracted hard link '%s' does not match: %v", restoredLink, err)
+	}
+
+	if !os.SameFile(mustStat(t, restoredLink), mustStat(t, restoredSecondLink)) {
+		t.Fatalf("Hard link '%s' was not extracted as link to '%s'", restoredSecondLink, restoredLink)
+	}
+}
+
+func mustStat(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info
+}
+
+func TestWriteArchiveSparse(t *testing.T) {
+	sourcePath := filepath.Join(t.TempDir(), "source")
+	if err := os.MkdirAll(sourcePath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// 64 MiB file with a few data regions in between holes and a trailing hole
+	sparsePath := filepath.Join(sourcePath, "disk.img")
+	file, err := os.Create(sparsePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range []int64{0, 8 << 20, 40 << 20} {
+		if _, err := file.WriteAt([]byte(strings.Repeat("data", 1024)), offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := file.Truncate(64 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+
+	regions, err := dataRegions(mustOpen(t, sparsePath), mustStat(t, sparsePath))
+	if err != nil || regions == nil {
+		t.Skip("holes are not detected on this platform or file system")
+	}
+
+	files := []BackupFileMetadata{{Path: sparsePath, BackupBasePath: sourcePath}}
+	unit := testUnit("tar")
+
+	archivePath := filepath.Join(t.TempDir(), "test.tar")
+	if err := WriteArchive(archivePath, files, unit); err != nil {
+		t.Fatal(err)
+	}
+
+	if size := mustStat(t, archivePath).Size(); size > 1<<20 {
+		t.Fatalf("Archive of sparse file has a size of %d bytes", size)
+	}
+
+	checkArchive(t, archivePath, files, unit)
+
+	targetPath := t.TempDir()
+	if err := Restore(archivePath, targetPath, Keys{}); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredPath, _ := restorePath(targetPath, getPathInArchive(sparsePath, sourcePath, unit))
+	if size := mustStat(t, restoredPath).Size(); size != 64<<20 {
+		t.Fatalf("Sparse file was restored with a size of %d bytes", size)
+	}
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { file.Close() })
+
+	return file
+}
+
+func TestWriteArchiveZipSymlinks(t *testing.T) {
+	files := createTestFiles(t)
+
+	linkPath := filepath.Join(files[0].BackupBasePath, "link.txt")
+	if err := os.Symlink(filepath.Base(files[0].Path), linkPath); err != nil {
+		t.Skipf("Can't create symlinks: %v", err)
+	}
+
+	files = append(files, BackupFileMetadata{Path: linkPath, BackupBasePath: files[0].BackupBasePath})
+
+	for _, workers := range []int{1, 4} {
+		unit := testUnit("zip")
+		unit.Workers = workers
+
+		archivePath := filepath.Join(t.TempDir(), "test.zip")
+		if err := WriteArchive(archivePath, files, unit); err != nil {
+			t.Fatal(err)
+		}
+
+		targetPath := t.TempDir()
+		if err := Restore(archivePath, targetPath, Keys{}); err != nil {
+			t.Fatal(err)
+		}
+
+		restoredLink, _ := restorePath(targetPath, getPathInArchive(linkPath, files[0].BackupBasePath, unit))
+
+		target, err := os.Readlink(restoredLink)
+		if err != nil {
+			t.Fatalf("Symlink was not restored as link with %d workers: %v", workers, err)
+		}
+
+		if target != filepath.Base(files[0].Path) {
+			t.Fatalf("Symlink was restored with target '%s' instead of '%s'", target, filepath.Base(files[0].Path))
+		}
+	}
+}
+
+func TestRestoreSymlinkEscape(t *testing.T) {
+	outsidePath := t.TempDir()
+	archivePath := filepath.Join(t.TempDir(), "crafted.tar")
+
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tw := tar.NewWriter(file)
+	entries := []struct {
+		header  tar.Header
+		content string
+	}{
+		{tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outsidePath, Mode: 0o777}, ""},
+		{tar.Header{Name: "a/pwned", Typeflag: tar.TypeReg, Mode: 0o644, Size: 5}, "owned"},
+		{tar.Header{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "../../escape", Mode: 0o777}, ""},
+		{tar.Header{Name: "dir/c", Typeflag: tar.TypeSymlink, Linkname: "../a", Mode: 0o777}, ""},
+		{tar.Header{Name: "dir/c/through", Typeflag: tar.TypeReg, Mode: 0o644, Size: 5}, "owned"},
+	}
+
+	for _, entry := range entries {
+		header := entry.header
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+
+	targetPath := t.TempDir()
+	if err := Restore(archivePath, targetPath, Keys{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outsidePath, "pwned")); err == nil {
+		t.Fatal("Entry was written outside of the target directory through a symlink")
+	}
+
+	for _, name := range []string{"a", "b"} {
+		if stat, err := os.Lstat(filepath.Join(targetPath, name)); err == nil && stat.Mode()&os.ModeSymlink != 0 {
+			t.Fatalf("Symlink '%s' pointing outside of the target directory was restored", name)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(targetPath, "a", "through")); err == nil {
+		t.Fatal("Entry was written through a symlink restored earlier")
+	}
+
+	if target, err := os.Readlink(filepath.Join(targetPath, "dir", "c")); err != nil || target != "../a" {
+		t.Fatalf("Symlink within the target directory was not restored: %v", err)
+	}
+}
+
+func TestRestoreDirectories(t *testing.T) {
+	files := createTestFiles(t)
+	sourcePath := files[0].BackupBasePath
+
+	emptyPath := filepath.Join(sourcePath, "empty")
+	if err := os.Mkdir(emptyPath, 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(emptyPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	files = append(files, BackupFileMetadata{Path: emptyPath, BackupBasePath: sourcePath, IsDir: true})
+
+	for _, archiveType := range []string{"tar", "zip"} {
+		unit := testUnit(archiveType)
+		unit.Directories = "empty"
+
+		archivePath := filepath.Join(t.TempDir(), "test."+archiveType)
+		if err := WriteArchive(archivePath, files, unit); err != nil {
+			t.Fatal(err)
+		}
+
+		targetPath := t.TempDir()
+		if err := Restore(archivePath, targetPath, Keys{}); err != nil {
+			t.Fatal(err)
+		}
+
+		restoredPath, _ := restorePath(targetPath, getPathInArchive(emptyPath, sourcePath, unit))
+		info := mustStat(t, restoredPath)
+
+		if !info.IsDir() || info.Mode().Perm() != 0o750 || !info.ModTime().Equal(modTime) {
+			t.Fatalf("Directory was restored with mode %s and mtime %s from %s archive", info.Mode(), info.ModTime(), archiveType)
+		}
+	}
+}
+
+func TestWriteArchiveFifo(t *testing.T) {
+	files := createTestFiles(t)
+	sourcePath := files[0].BackupBasePath
+
+	fifoPath := filepath.Join(sourcePath, "pipe")
+	if err := createSpecialFile(&tar.Header{Typeflag: tar.TypeFifo, Mode: 0o640}, fifoPath); err != nil {
+		t.Skipf("Can't create FIFO: %v", err)
+	}
+
+	files = append(files, BackupFileMetadata{Path: fifoPath, BackupBasePath: sourcePath})
+
+	for _, archiveType := range []string{"tar", "zip"} {
+		unit := testUnit(archiveType)
+
+		archivePath := filepath.Join(t.TempDir(), "test."+archiveType)
+		if err := WriteArchive(archivePath, files, unit); err != nil {
+			t.Fatal(err)
+		}
+
+		targetPath := t.TempDir()
+		if err := Restore(archivePath, targetPath, Keys{}); err != nil {
+			t.Fatal(err)
+		}
+
+		restoredPath, _ := restorePath(targetPath, getPathInArchive(fifoPath, sourcePath, unit))
+		info, err := os.Lstat(restoredPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode()&os.ModeNamedPipe == 0 || info.Mode().Perm() != 0o640 {
+			t.Fatalf("FIFO was restored with mode %s from %s archive", info.Mode(), archiveType)
+		}
+	}
+}
+
+func TestWriteArchiveReproducible(t *testing.T) {
+	files := createTestFiles(t)
+
+	reversed := make([]BackupFileMetadata, len(files))
+	for i, file := range files {
+		reversed[len(files)-1-i] = file
+	}
+
+	for _, archiveType := range ArchiveTypes() {
+		unit := testUnit(archiveType)
+		unit.Reproducible = true
+		unit.Sources = []string{files[0].BackupBasePath, "/other"}
+
+		// Options which don't affect the content of the archive are not part of the config hash in the manifest
+		otherUnit := unit
+		otherUnit.Sources = []string{"/other", files[0].BackupBasePath}
+		otherUnit.Destination = "/elsewhere"
+		otherUnit.MemoryBudget = 2 << 20
+
+		var archives [][]byte
+
+		for i, order := range [][]BackupFileMetadata{files, reversed} {
+			archiveUnit := unit
+			if i == 1 {
+				archiveUnit = otherUnit
+			}
+
+			archivePath := filepath.Join(t.TempDir(), "test."+archiveType)
+			if err := WriteArchive(archivePath, order, archiveUnit); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			archives = append(archives, data)
+		}
+
+		if !bytes.Equal(archives[0], archives[1]) {
+			t.Fatalf("Reproducible %s archives differ", archiveType)
+		}
+	}
+}
+
+func TestWriteArchiveTarFormats(t *testing.T) {
+	files := createTestFiles(t)
+	sourcePath := files[0].BackupBasePath
+
+	// Names longer than 256 characters can't be stored in USTAR headers
+	longDir := strings.Repeat("long", 20)
+	longPath := filepath.Join(sourcePath, longDir, longDir, longDir, longDir, "file.txt")
+
+	if err := os.MkdirAll(filepath.Dir(longPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(longPath, []byte("long"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	if err := os.Chtimes(longPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	files = append(files, BackupFileMetadata{Path: longPath, BackupBasePath: sourcePath})
+
+	for _, tarFormat := range []string{"ustar", "pax", "gnu"} {
+		unit := testUnit("tar")
+		unit.TarFormat = tarFormat
+		unit.TimestampPrecision = "second"
+
+		if tarFormat == "pax" {
+			unit.TimestampPrecision = "nanosecond"
+		}
+
+		archivePath := filepath.Join(t.TempDir(), "test.tar")
+		if err := WriteArchive(archivePath, files, unit); err != nil {
+			t.Fatal(err)
+		}
+
+		checkArchive(t, archivePath, files, unit)
+
+		reader, err := OpenReader(archivePath, Keys{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for {
+			header, err := reader.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if header.Name != getPathInArchive(longPath, sourcePath, unit) {
+				continue
+			}
+
+			if tarFormat == "pax" && !header.ModTime.Equal(modTime) {
+				t.Fatalf("Modification time was stored as %s in %s format", header.ModTime, tarFormat)
+			}
+
+			break
+		}
+
+		reader.Close()
+	}
+}
+
+func TestOrderEntries(t *testing.T) {
+	files := createTestFiles(t)
+	unit := testUnit("tar.gz")
+
+	expectedNames := map[string][]string{
+		"path":      {"a.txt", "b.log", "c.csv"},
+		"extension": {"c.csv", "b.log", "a.txt"},
+		"size":      {"a.txt", "c.csv", "b.log"},
+	}
+
+	for order, expected := range expectedNames {
+		ordered := OrderEntries(files, order, unit)
+
+		for i, file := range ordered {
+			if filepath.Base(file.Path) != expected[i] {
+				t.Fatalf("Entry %d is '%s' instead of '%s' with order '%s'", i, filepath.Base(file.Path), expected[i], order)
+			}
+		}
+	}
+
+	ratios, err := CompareEntryOrders(files, unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ratios) != len(config.EntryOrders) {
+		t.Fatalf("Got compression ratios for %d instead of %d entry orders", len(ratios), len(config.EntryOrders))
+	}
+}
+
+func TestSampleFiles(t *testing.T) {
+	sourcePath := t.TempDir()
+
+	// 64 sparse files of 1 MiB each, twice the sample size
+	var files []BackupFileMetadata
+	for i := 0; i < 64; i++ {
+		path := filepath.Join(sourcePath, fmt.Sprintf("%02d.bin", i))
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.Truncate(path, 1<<20); err != nil {
+			t.Fatal(err)
+		}
+
+		files = append(files, BackupFileMetadata{Path: path, BackupBasePath: sourcePath})
+	}
+
+	sample := sampleFiles(files)
+	if len(sample) != 32 {
+		t.Fatalf("Sampled %d files instead of 32", len(sample))
+	}
+
+	if last := sample[len(sample)-1].Path; last != files[len(files)-1].Path {
+		t.Fatalf("Sample does not cover the whole list, the last sampled file is '%s'", last)
+	}
+}
+
+func TestWriteArchiveManifest(t *testing.T) {
+	files := createTestFiles(t)
+
+	// A followed symlink is described by its target
+	linkPath := filepath.Join(files[0].BackupBasePath, "link.txt")
+	if err := os.Symlink(files[0].Path, linkPath); err != nil {
+		t.Skipf("Can't create symlinks: %v", err)
+	}
+
+	files = append(files, BackupFileMetadata{Path: linkPath, BackupBasePath: files[0].BackupBasePath})
+
+	for _, workers := range []int{1, 4} {
+		for _, archiveType := range []string{"tar.gz", "zip"} {
+			unit := testUnit(archiveType)
+			unit.FollowSymlinks = true
+			unit.Workers = workers
+
+			archivePath := filepath.Join(t.TempDir(), "test."+archiveType)
+			if err := WriteArchive(archivePath, files, unit); err != nil {
+				t.Fatal(err)
+			}
+
+			manifest := readManifest(t, archivePath)
+			if manifest.Unit != unit.Name || len(manifest.Files) != len(files) || manifest.StartTime == nil || manifest.EndTime == nil {
+				t.Fatalf("Manifest of %s archive is incomplete: %+v", archiveType, manifest)
+			}
+
+			contents := readArchive(t, archivePath)
+			for _, file := range manifest.Files {
+				content := contents[file.Path]
+				hash := sha256.Sum256([]byte(content))
+
+				if file.SHA256 != hex.EncodeToString(hash[:]) || file.Size != int64(len(content)) || file.Mode != "-rw-r--r--" {
+					t.Fatalf("Manifest entry of '%s' in %s archive does not match its content: %+v", file.Path, archiveType, file)
+				}
+			}
+		}
+	}
+}
+
+// readManifest reads the manifest of an archive, which has to be its first entry
+func readManifest(t *testing.T, archivePath string) Manifest {
+	t.Helper()
+
+	reader, err := OpenReader(archivePath, Keys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	header, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Name != ManifestPath {
+		t.Fatalf("First entry of '%s' is '%s' instead of the manifest", archivePath, header.Name)
+	}
+
+	var manifest Manifest
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	return manifest
+}
+
+func TestWriteArchiveSidecarFiles(t *testing.T) {
+	files := createTestFiles(t)
+
+	for _, volumeSize := range []int64{0, 200} {
+		unit := testUnit("tar.gz")
+		unit.VolumeSize = volumeSize
+		unit.ManifestFile = true
+
+		archiveDir := t.TempDir()
+		archivePath := filepath.Join(archiveDir, "test.tar.gz")
+
+		if err := WriteArchive(archivePath, files, unit); err != nil {
+			t.Fatal(err)
+		}
+
+		checksums, err := os.ReadFile(archivePath + ".sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(string(checksums)), "\n")
+		if volumeSize > 0 && len(lines) != len(findVolumes(archivePath)) {
+			t.Fatalf("Checksum file contains %d lines for %d volumes", len(lines), len(findVolumes(archivePath)))
+		}
+
+		for _, line := range lines {
+			sum, name, found := strings.Cut(line, "  ")
+			if !found {
+				t.Fatalf("Invalid line in checksum file: '%s'", line)
+			}
+
+			data, err := os.ReadFile(filepath.Join(archiveDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hash := sha256.Sum256(data)
+			if sum != hex.EncodeToString(hash[:]) {
+				t.Fatalf("Checksum of '%s' does not match", name)
+			}
+		}
+
+		if _, err := os.Stat(filepath.Join(archiveDir, "test.manifest.json")); err != nil {
+			t.Fatalf("Manifest file was not written: %v", err)
+		}
+	}
+}
+
+func TestGetPathInArchive(t *testing.T) {
+	sourcePath := filepath.FromSlash("/var/lib/postgresql/16/main")
+	filePath := filepath.Join(sourcePath, "base", "1")
+
+	expectedPaths := map[string]string{
+		"absolute":           "var/lib/postgresql/16/main/base/1",
+		"relative_to_source": "base/1",
+		"relative_to_parent": "main/base/1",
+	}
+
+	for pathMode, expected := range expectedPaths {
+		unit := testUnit("tar")
+		unit.PathMode = pathMode
+
+		if pathInArchive := getPathInArchive(filePath, sourcePath, unit); pathInArchive != expected {
+			t.Fatalf("Path in archive is '%s' instead of '%s' in %s mode", pathInArchive, expected, pathMode)
+		}
+
+		unit.ArchivePrefixes = map[string]string{sourcePath: "postgres"}
+
+		if pathInArchive := getPathInArchive(filePath, sourcePath, unit); pathInArchive != "postgres/base/1" {
+			t.Fatalf("Path in archive is '%s' instead of 'postgres/base/1' with archive prefix in %s mode", pathInArchive, pathMode)
+		}
+
+		if pathInArchive := getPathInArchive(sourcePath, sourcePath, unit); pathInArchive != "postgres" {
+			t.Fatalf("Source directory is stored as '%s' instead of 'postgres' in %s mode", pathInArchive, pathMode)
+		}
+	}
+
+	unit := testUnit("tar")
+	unit.PathMode = "relative_to_source"
+
+	if pathInArchive := getPathInArchive(sourcePath, sourcePath, unit); pathInArchive != "" {
+		t.Fatalf("Source directory is stored as '%s' in relative_to_source mode", pathInArchive)
+	}
+}
+
+func TestWriteMirror(t *testing.T) {
+	files := createTestFiles(t)
+	unit := testUnit(MirrorArchiveType)
+	destination := t.TempDir()
+
+	firstPath := filepath.Join(destination, "test-2026-01-01_10-00")
+	if err := WriteArchive(firstPath, files, unit); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change one file, its modification time is set explicitly to not depend on the timer resolution
+	changedFile := files[0]
+	if err := os.WriteFile(changedFile.Path, []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(changedFile.Path, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	secondPath := filepath.Join(destination, "test-2026-01-01_10-01")
+	if err := WriteArchive(secondPath, files, unit); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(secondPath + partialSuffix); !os.IsNotExist(err) {
+		t.Fatalf("Partial snapshot was not renamed")
+	}
+
+	if _, err := os.Stat(filepath.Join(secondPath, filepath.FromSlash(ManifestPath))); err != nil {
+		t.Fatalf("Snapshot contains no manifest: %v", err)
+	}
+
+	for _, file := range files {
+		pathInArchive := getPathInArchive(file.Path, file.BackupBasePath, unit)
+		firstFile, _ := restorePath(firstPath, pathInArchive)
+		secondFile, _ := restorePath(secondPath, pathInArchive)
+
+		expected, err := os.ReadFile(file.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if content, err := os.ReadFile(secondFile); err != nil || !bytes.Equal(content, expected) {
+			t.Fatalf("Content of '%s' in the snapshot does not match", pathInArchive)
+		}
+
+		linked := os.SameFile(mustStat(t, firstFile), mustStat(t, secondFile))
+		if file == changedFile && linked {
+			t.Fatalf("Changed file '%s' was linked against the previous snapshot", pathInArchive)
+		} else if file != changedFile && !linked {
+			t.Fatalf("Unchanged file '%s' was not linked against the previous snapshot", pathInArchive)
+		}
+	}
+
+	// Linked files take their hash from the previous manifest, copied files are hashed while they are copied
+	data, err := os.ReadFile(filepath.Join(secondPath, filepath.FromSlash(ManifestPath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifest.Files) != len(files) {
+		t.Fatalf("Manifest of the snapshot lists %d instead of %d files", len(manifest.Files), len(files))
+	}
+
+	for _, file := range manifest.Files {
+		content, _ := os.ReadFile(filepath.Join(secondPath, filepath.FromSlash(file.Path)))
+		hash := sha256.Sum256(content)
+
+		if file.SHA256 != hex.EncodeToString(hash[:]) || file.Size != int64(len(content)) {
+			t.Fatalf("Manifest entry of '%s' does not match the snapshot: %+v", file.Path, file)
+		}
+	}
+}
+
+func TestParseSnapshotName(t *testing.T) {
+	names := map[string]int{
+		"test-2026-01-01_10-00":   0,
+		"test-2026-01-01_10-00-3": 3,
+	}
+
+	for name, expected := range names {
+		if _, counter, ok := parseSnapshotName(name, "test"); !ok || counter != expected {
+			t.Fatalf("Snapshot name '%s' was parsed with counter %d instead of %d", name, counter, expected)
+		}
+	}
+
+	for _, name := range []string{"test-2026-01-01_10-00.partial", "test-old-2026-01-01_10-00", "test-2026-01-01_10-00.tar.gz"} {
+		if _, _, ok := parseSnapshotName(name, "test"); ok {
+			t.Fatalf("'%s' was parsed as snapshot name", name)
+		}
+	}
+}
+
+func TestSeekableArchive(t *testing.T) {
+	files := createTestFiles(t)
+	sourcePath := files[0].BackupBasePath
+
+	// Large files fill several blocks
+	for i := 0; i < 3; i++ {
+		largePath := filepath.Join(sourcePath, "large", strings.Repeat("x", i+1)+".bin")
+		if err := os.MkdirAll(filepath.Dir(largePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(largePath, bytes.Repeat([]byte(fmt.Sprintf("block %d\n", i)), seekableBlockSize/4), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		files = append(files, BackupFileMetadata{Path: largePath, BackupBasePath: sourcePath})
+	}
+
+	for _, archiveType := range []string{"tar.gz", "tar.zst"} {
+		unit := testUnit(archiveType)
+		unit.Seekable = true
+		archivePath := filepath.Join(t.TempDir(), "backup."+archiveType)
+
+		if err := WriteArchive(archivePath, files, unit); err != nil {
+			t.Fatal(err)
+		}
+
+		// Seekable archives stay regular archives
+		checkArchive(t, archivePath, files, unit)
+
+		index, err := readSeekIndex(archivePath)
+		if err != nil || index == nil {
+			t.Fatalf("Can't read seek index of '%s': %v", archivePath, err)
+		}
+
+		offsets := make(map[int64]bool)
+		for _, entry := range index.Entries {
+			offsets[entry.Offset] = true
+		}
+
+		if len(index.Entries) != len(files)+1 || len(offsets) < 3 {
+			t.Fatalf("Seek index of '%s' has %d entries in %d blocks", archivePath, len(index.Entries), len(offsets))
+		}
+
+		var listing bytes.Buffer
+		if err := List(archivePath, &listing, Keys{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if lines := strings.Count(listing.String(), "\n"); lines != len(files)+1 {
+			t.Fatalf("Listing of '%s' contains %d instead of %d entries", archivePath, lines, len(files)+1)
+		}
+
+		// Extract a file from the middle of the archive
+		extractedFile := files[len(files)-2]
+		pathInArchive := getPathInArchive(extractedFile.Path, extractedFile.BackupBasePath, unit)
+		targetPath := t.TempDir()
+
+		if err := Extract(archivePath, targetPath, []string{pathInArchive}, Keys{}); err != nil {
+			t.Fatal(err)
+		}
+
+		restoredPath, _ := restorePath(targetPath, pathInArchive)
+		expected, _ := os.ReadFile(extractedFile.Path)
+
+		if content, err := os.ReadFile(restoredPath); err != nil || !bytes.Equal(content, expected) {
+			t.Fatalf("Content of extracted entry '%s' does not match: %v", pathInArchive, err)
+		}
+
+		otherPath, _ := restorePath(targetPath, getPathInArchive(files[0].Path, files[0].BackupBasePath, unit))
+		if _, err := os.Stat(otherPath); !os.IsNotExist(err) {
+			t.Fatalf("Entry which was not requested was extracted")
+		}
+	}
+}
+
+func TestRecoveryRepair(t *testing.T) {
+	files := createTestFiles(t)
+	sourcePath := files[0].BackupBasePath
+
+	// Random data spanning two segments
+	largePath := filepath.Join(sourcePath, "large.bin")
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, recoveryBlockSize*recoveryDataShards+recoveryBlockSize*10)
+	random.Read(data)
+
+	if err := os.WriteFile(largePath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	files = append(files, BackupFileMetadata{Path: largePath, BackupBasePath: sourcePath})
+
+	unit := testUnit("tar")
+	unit.RecoveryPercent = 5
+	archivePath := filepath.Join(t.TempDir(), "backup.tar")
+
+	if err := WriteArchive(archivePath, files, unit); err != nil {
+		t.Fatal(err)
+	}
+
+	original, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := readRecoveryHeader(mustOpen(t, recoveryPath(archivePath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockSize := int(header.BlockSize)
+
+	if err := Repair(archivePath); err != nil {
+		t.Fatalf("Intact archive can't be verified: %v", err)
+	}
+
+	// Corrupt a few blocks and cut off the end of the archive
+	corrupted := append([]byte(nil), original...)
+	for _, offset := range []int{100, blockSize * 7, blockSize*7 + 10} {
+		corrupted[offset] ^= 0xff
+	}
+
+	if err := os.WriteFile(archivePath, corrupted[:len(corrupted)-1000], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Repair(archivePath); err != nil {
+		t.Fatal(err)
+	}
+
+	if repaired, _ := os.ReadFile(archivePath); !bytes.Equal(repaired, original) {
+		t.Fatalf("Repaired archive does not match the original archive")
+	}
+
+	// More corrupted blocks than recovery blocks in a segment can't be repaired
+	for i := 0; i < 10; i++ {
+		corrupted[i*blockSize] ^= 0xff
+	}
+
+	if err := os.WriteFile(archivePath, corrupted, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Repair(archivePath); !errors.Is(err, bkperrors.ErrUnrepairable) {
+		t.Fatalf("Repairing too many corrupted blocks returned %v", err)
+	}
+}
+
+func TestRecoveryFileSize(t *testing.T) {
+	files := createTestFiles(t)
+	sourcePath := files[0].BackupBasePath
+
+	largePath := filepath.Join(sourcePath, "large.bin")
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	if err := os.WriteFile(largePath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		files   []BackupFileMetadata
+		percent int
+		// maxSize is the maximum size of the recovery file in percent of the archive size
+		maxSize int64
+	}{
+		// The recovery blocks of tiny archives are dominated by the checksums and the header
+		{files, 5, 25},
+		{append(files, BackupFileMetadata{Path: largePath, BackupBasePath: sourcePath}), 5, 7},
+		{append(files, BackupFileMetadata{Path: largePath, BackupBasePath: sourcePath}), 20, 23},
+	} {
+		unit := testUnit("tar.gz")
+		unit.RecoveryPercent = test.percent
+		archivePath := filepath.Join(t.TempDir(), "backup.tar.gz")
+
+		if err := WriteArchive(archivePath, test.files, unit); err != nil {
+			t.Fatal(err)
+		}
+
+		archiveSize, recoverySize := mustStat(t, archivePath).Size(), mustStat(t, recoveryPath(archivePath)).Size()
+		if recoverySize*100 > archiveSize*test.maxSize {
+			t.Fatalf("Recovery file with %d%% redundancy has %d bytes for an archive of %d bytes", test.percent, recoverySize, archiveSize)
+		}
+
+		if err := Repair(archivePath); err != nil {
+			t.Fatalf("Intact archive can't be verified: %v", err)
+		}
+	}
+}
+
+func TestEncryptedArchive(t *testing.T) {
+	files := createTestFiles(t)
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("BACKMEUP_TEST_PASSPHRASE", "correct horse battery staple")
+
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("correct horse battery staple\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	passphraseKeys, err := ReadKeys(nil, passphraseFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, archiveType := range []string{"tar.gz", "zip"} {
+		unit := testUnit(archiveType)
+		unit.Encryption = "age"
+		unit.Recipients = []string{identity.Recipient().String()}
+
+		recipientUnit := unit
+		passphraseUnit := unit
+		passphraseUnit.Recipients = nil
+		passphraseUnit.PassphraseEnv = "BACKMEUP_TEST_PASSPHRASE"
+
+		for _, test := range []struct {
+			unit config.Unit
+			keys Keys
+		}{
+			{recipientUnit, Keys{Identities: []age.Identity{identity}}},
+			{passphraseUnit, passphraseKeys},
+		} {
+			archivePath := filepath.Join(t.TempDir(), "backup."+archiveType+AgeExtension)
+
+			if err := WriteArchive(archivePath, files, test.unit); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := List(archivePath, io.Discard, Keys{}); err == nil {
+				t.Fatalf("Encrypted archive '%s' was listed without identity", archivePath)
+			}
+
+			targetPath := t.TempDir()
+			if err := Restore(archivePath, targetPath, test.keys); err != nil {
+				t.Fatalf("Can't restore encrypted archive '%s': %v", archivePath, err)
+			}
+
+			for _, file := range files {
+				restoredPath, _ := restorePath(targetPath, getPathInArchive(file.Path, file.BackupBasePath, test.unit))
+				expected, _ := os.ReadFile(file.Path)
+
+				if content, err := os.ReadFile(restoredPath); err != nil || !bytes.Equal(content, expected) {
+					t.Fatalf("Content of '%s' restored from '%s' does not match", restoredPath, archivePath)
+				}
+			}
+		}
+	}
+}
+
+func TestAESEncryptedZip(t *testing.T) {
+	files := createTestFiles(t)
+
+	// Symlinks are stored unencrypted
+	linkPath := filepath.Join(files[0].BackupBasePath, "link.txt")
+	linkTarget, _ := filepath.Rel(files[0].BackupBasePath, files[0].Path)
+
+	if err := os.Symlink(linkTarget, linkPath); err != nil {
+		t.Skipf("Can't create symlinks: %v", err)
+	}
+
+	files = append(files, BackupFileMetadata{Path: linkPath, BackupBasePath: files[0].BackupBasePath})
+
+	t.Setenv("BACKMEUP_TEST_PASSWORD", "correct horse battery staple")
+
+	for _, zipMethod := range []string{"store", "deflate", "zstd"} {
+		for _, workers := range []int{1, 4} {
+			unit := testUnit("zip")
+			unit.ZipMethod = zipMethod
+			unit.Workers = workers
+			unit.Encryption = "aes256"
+			unit.PassphraseEnv = "BACKMEUP_TEST_PASSWORD"
+
+			archivePath := filepath.Join(t.TempDir(), "backup.zip")
+
+			if err := WriteArchive(archivePath, files, unit); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Restore(archivePath, t.TempDir(), Keys{Password: "wrong password"}); !errors.Is(err, bkperrors.ErrWrongPassword) {
+				t.Fatalf("Restoring '%s' with a wrong password returned %v", archivePath, err)
+			}
+
+			targetPath := t.TempDir()
+			if err := Restore(archivePath, targetPath, Keys{Password: "correct horse battery staple"}); err != nil {
+				t.Fatalf("Can't restore encrypted archive '%s': %v", archivePath, err)
+			}
+
+			for _, file := range files {
+				restoredPath, _ := restorePath(targetPath, getPathInArchive(file.Path, file.BackupBasePath, unit))
+				expected, _ := os.ReadFile(file.Path)
+
+				if content, err := os.ReadFile(restoredPath); err != nil || !bytes.Equal(content, expected) {
+					t.Fatalf("Content of '%s' restored from '%s' with %s does not match", restoredPath, archivePath, zipMethod)
+				}
+			}
+
+			restoredLinkPath, _ := restorePath(targetPath, getPathInArchive(linkPath, files[0].BackupBasePath, unit))
+			if restoredTarget, err := os.Readlink(restoredLinkPath); err != nil || restoredTarget != linkTarget {
+				t.Fatalf("Symlink restored from '%s' points to '%s': %v", archivePath, restoredTarget, err)
+			}
+
+			zipReader, err := zip.OpenReader(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, file := range zipReader.File {
+				encrypted := file.Flags&0x1 != 0
+				if encrypted != file.Mode().IsRegular() {
+					t.Fatalf("Entry '%s' with mode %s is encrypted: %t", file.Name, file.Mode(), encrypted)
+				}
+			}
+
+			zipReader.Close()
+		}
+	}
+
+	// Comparing the entry orders doesn't ask for the password
+	unit := testUnit("zip")
+	unit.Encryption = "aes256"
+
+	if _, err := CompareEntryOrders(files, unit); err != nil {
+		t.Fatalf("Comparing entry orders of an encrypted zip archive failed: %v", err)
+	}
+}
+
+func TestCompressionLevels(t *testing.T) {
+	files := createTestFiles(t)
+
+	levelRanges := []struct {
+		archiveType string
+		minLevel    int
+		maxLevel    int
+	}{
+		{"tar.gz", 0, 9},
+		{"tar.zst", 1, 22},
+		{"tar.xz", 0, 9},
+		{"tar.bz2", 1, 9},
+		{"tar.lz4", 0, 9},
+		{"zip", 0, 9},
+	}
+
+	for _, levels := range levelRanges {
+		for _, level := range []int{config.DefaultCompressionLevel, levels.minLevel, levels.maxLevel} {
+			if !config.ValidCompressionLevel(levels.archiveType, level) {
+				t.Fatalf("Compression level %d of archive type '%s' is rejected", level, levels.archiveType)
+			}
+
+			// The compressor must accept every level accepted by the config
+			unit := testUnit(levels.archiveType)
+			unit.CompressionLevel = level
+
+			archivePath := filepath.Join(t.TempDir(), "test."+levels.archiveType)
+			if err := WriteArchive(archivePath, files, unit); err != nil {
+				t.Fatalf("Can't write archive of type '%s' with compression level %d: %v", levels.archiveType, level, err)
+			}
+		}
+
+		for _, level := range []int{levels.minLevel - 1, levels.maxLevel + 1} {
+			if level != config.DefaultCompressionLevel && config.ValidCompressionLevel(levels.archiveType, level) {
+				t.Fatalf("Invalid compression level %d of archive type '%s' is accepted", level, levels.archiveType)
+			}
+		}
+	}
+
+	if !config.ValidCompressionLevel("tar", 42) {
+		t.Fatal("Compression level of uncompressed archives is validated")
+	}
+}
@@ -0,0 +1,150 @@
+package archiver
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// compressor wraps the given writer into a writer which compresses all data written to it
+type compressor func(w io.Writer, unit config.Unit) (io.WriteCloser, error)
+
+// gzipUnknownOS is the OS field of gzip headers, which is set to "unknown" independently of the host
+const gzipUnknownOS = 255
+
+// pgzipBlockSize is the size of the blocks which are compressed in parallel for gzip
+const pgzipBlockSize = 1 << 20
+
+// workerCount returns the number of workers the unit may use for compression
+func workerCount(unit config.Unit) int {
+	if unit.Workers < 1 {
+		return 1
+	}
+
+	return unit.Workers
+}
+
+// nopWriteCloser is used for uncompressed archives
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func newNopCompressor(w io.Writer, _ config.Unit) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func newGzipCompressor(w io.Writer, unit config.Unit) (io.WriteCloser, error) {
+	// gzip.DefaultCompression equals config.DefaultCompressionLevel
+	if unit.CompressionLevel < gzip.DefaultCompression || unit.CompressionLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip compression level %d (valid: 0-9)", unit.CompressionLevel)
+	}
+
+	// The gzip header holds neither a file name nor a timestamp, so identical input gives identical output
+	if workerCount(unit) == 1 {
+		gw, err := gzip.NewWriterLevel(w, unit.CompressionLevel)
+		if err != nil {
+			return nil, err
+		}
+
+		gw.Header = gzip.Header{OS: gzipUnknownOS}
+
+		return gw, nil
+	}
+
+	// pgzip compresses blocks of the stream in parallel but still produces a single regular gzip stream
+	pw, err := pgzip.NewWriterLevel(w, unit.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	pw.Header = pgzip.Header{OS: gzipUnknownOS}
+
+	if err := pw.SetConcurrency(pgzipBlockSize, workerCount(unit)); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+func newZstdCompressor(w io.Writer, unit config.Unit) (io.WriteCloser, error) {
+	level, err := zstdLevel(unit.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(workerCount(unit)))
+}
+
+// zstdLevel maps the zstd compression levels 1-22 to the encoder levels of klauspost/compress
+func zstdLevel(level int) (zstd.EncoderLevel, error) {
+	if level == config.DefaultCompressionLevel {
+		return zstd.SpeedDefault, nil
+	}
+
+	if level < 1 || level > 22 {
+		return zstd.SpeedDefault, fmt.Errorf("invalid zstd compression level %d (valid: 1-22)", level)
+	}
+
+	return zstd.EncoderLevelFromZstd(level), nil
+}
+
+// xzDictCaps contains the dictionary sizes of the xz presets 0-9, which is the main factor for the compression ratio
+var xzDictCaps = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+func newXzCompressor(w io.Writer, unit config.Unit) (io.WriteCloser, error) {
+	writerConfig := xz.WriterConfig{}
+
+	if unit.CompressionLevel != config.DefaultCompressionLevel {
+		if unit.CompressionLevel < 0 || unit.CompressionLevel >= len(xzDictCaps) {
+			return nil, fmt.Errorf("invalid xz compression level %d (valid: 0-9)", unit.CompressionLevel)
+		}
+
+		writerConfig.DictCap = xzDictCaps[unit.CompressionLevel]
+	}
+
+	return writerConfig.NewWriter(w)
+}
+
+func newBzip2Compressor(w io.Writer, unit config.Unit) (io.WriteCloser, error) {
+	writerConfig := bzip2.WriterConfig{}
+
+	if unit.CompressionLevel != config.DefaultCompressionLevel {
+		if unit.CompressionLevel < bzip2.BestSpeed || unit.CompressionLevel > bzip2.BestCompression {
+			return nil, fmt.Errorf("invalid bzip2 compression level %d (valid: 1-9)", unit.CompressionLevel)
+		}
+
+		writerConfig.Level = unit.CompressionLevel
+	}
+
+	return bzip2.NewWriter(w, &writerConfig)
+}
+
+// lz4Levels maps the compression levels 0-9 to the levels of pierrec/lz4
+var lz4Levels = []lz4.CompressionLevel{lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9}
+
+func newLz4Compressor(w io.Writer, unit config.Unit) (io.WriteCloser, error) {
+	zw := lz4.NewWriter(w)
+
+	if unit.CompressionLevel != config.DefaultCompressionLevel {
+		if unit.CompressionLevel < 0 || unit.CompressionLevel >= len(lz4Levels) {
+			return nil, fmt.Errorf("invalid lz4 compression level %d (valid: 0-9)", unit.CompressionLevel)
+		}
+
+		if err := zw.Apply(lz4.CompressionLevelOption(lz4Levels[unit.CompressionLevel])); err != nil {
+			return nil, err
+		}
+	}
+
+	return zw, nil
+}
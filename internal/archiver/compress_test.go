@@ -0,0 +1,63 @@
+package archiver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestParallelCompressors(t *testing.T) {
+	// Random and compressible data spanning several blocks, which are compressed in parallel
+	data := make([]byte, 4*pgzipBlockSize+1234)
+	rand.New(rand.NewSource(1)).Read(data[:2*pgzipBlockSize])
+	copy(data[2*pgzipBlockSize:], strings.Repeat("log line\n", len(data)))
+
+	// The output can be read by the regular single-threaded decompressors
+	decompressors := map[string]func(r io.Reader) (io.Reader, error){
+		"tar.gz": func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		"tar.zst": func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	}
+	compressors := map[string]compressor{"tar.gz": newGzipCompressor, "tar.zst": newZstdCompressor}
+
+	for archiveType, newCompressor := range compressors {
+		unit := config.Unit{CompressionLevel: config.DefaultCompressionLevel, Workers: 4}
+
+		var compressed bytes.Buffer
+		cw, err := newCompressor(&compressed, unit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := cw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := decompressors[archiveType](&compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decompressed, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Can't decompress %s compressed with %d workers: %v", archiveType, unit.Workers, err)
+		}
+
+		if !bytes.Equal(decompressed, data) {
+			t.Fatalf("Data compressed with %d workers as %s does not match", unit.Workers, archiveType)
+		}
+	}
+}
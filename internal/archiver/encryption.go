@@ -0,0 +1,140 @@
+package archiver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+)
+
+// AgeExtension is appended to the names of archives encrypted with age
+const AgeExtension = ".age"
+
+// newEncryptor wraps the given writer into a writer, which encrypts all data written to it for the recipients
+// of the unit. The encryption is finished by closing the returned writer.
+func newEncryptor(w io.Writer, unit config.Unit) (io.WriteCloser, error) {
+	recipients, err := ageRecipients(unit)
+	if err != nil {
+		return nil, err
+	}
+
+	return age.Encrypt(w, recipients...)
+}
+
+// ageRecipients returns the X25519 recipients of the unit or a scrypt recipient for its passphrase
+func ageRecipients(unit config.Unit) ([]age.Recipient, error) {
+	if unit.PassphraseFile == "" && unit.PassphraseEnv == "" {
+		recipients := make([]age.Recipient, 0, len(unit.Recipients))
+
+		for _, recipient := range unit.Recipients {
+			parsed, err := age.ParseX25519Recipient(recipient)
+			if err != nil {
+				return nil, err
+			}
+
+			recipients = append(recipients, parsed)
+		}
+
+		return recipients, nil
+	}
+
+	passphrase, err := readPassphrase(unit.PassphraseFile, unit.PassphraseEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return []age.Recipient{recipient}, nil
+}
+
+// readPassphrase reads the passphrase from the given file or environment variable
+func readPassphrase(passphraseFile string, passphraseEnv string) (string, error) {
+	var passphrase string
+
+	if passphraseFile != "" {
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("reading passphrase file: %w", err)
+		}
+
+		// Editors usually end files with a newline, which is not part of the passphrase
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	} else {
+		passphrase = os.Getenv(passphraseEnv)
+	}
+
+	if passphrase == "" {
+		return "", errors.New("the passphrase is empty")
+	}
+
+	return passphrase, nil
+}
+
+// Keys are the secrets for reading encrypted archives
+type Keys struct {
+	// Identities decrypt archives encrypted with age
+	Identities []age.Identity
+	// Password decrypts the entries of AES encrypted zip archives
+	Password string
+}
+
+// ReadKeys reads the age identities from the given identity files and, if given, the passphrase
+// from the passphrase file, which is used for both age and zip archives
+func ReadKeys(identityFiles []string, passphraseFile string) (Keys, error) {
+	var keys Keys
+
+	for _, identityFile := range identityFiles {
+		file, err := os.Open(identityFile)
+		if err != nil {
+			return keys, err
+		}
+
+		parsed, err := age.ParseIdentities(file)
+		file.Close()
+
+		if err != nil {
+			return keys, fmt.Errorf("parsing identity file '%s': %w", identityFile, err)
+		}
+
+		keys.Identities = append(keys.Identities, parsed...)
+	}
+
+	if passphraseFile != "" {
+		passphrase, err := readPassphrase(passphraseFile, "")
+		if err != nil {
+			return keys, err
+		}
+
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return keys, err
+		}
+
+		keys.Identities = append(keys.Identities, identity)
+		keys.Password = passphrase
+	}
+
+	return keys, nil
+}
+
+// cutEncryptionSuffix removes the extension of encrypted archives from the path
+func cutEncryptionSuffix(archivePath string) (string, bool) {
+	return strings.CutSuffix(archivePath, AgeExtension)
+}
+
+// decryptArchive returns a reader for the decrypted content of an encrypted archive
+func decryptArchive(r io.Reader, identities []age.Identity) (io.Reader, error) {
+	if len(identities) == 0 {
+		return nil, errors.New("the archive is encrypted, but no identity was given")
+	}
+
+	return age.Decrypt(r, identities...)
+}
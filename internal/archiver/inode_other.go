@@ -0,0 +1,16 @@
+//go:build !unix
+
+package archiver
+
+import "io/fs"
+
+// inodeOf returns the device and inode of a file and whether it has more than one hard link.
+// Hard links are not detected on this platform.
+func inodeOf(_ fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// ownerOf returns false, because files have no unix owner on this platform
+func ownerOf(_ fs.FileInfo) (uint32, uint32, bool) {
+	return 0, 0, false
+}
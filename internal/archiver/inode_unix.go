@@ -0,0 +1,28 @@
+//go:build unix
+
+package archiver
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// inodeOf returns the device and inode of a file and whether it has more than one hard link
+func inodeOf(info fs.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+
+	return fileID{device: uint64(stat.Dev), inode: uint64(stat.Ino)}, stat.Nlink > 1
+}
+
+// ownerOf returns the uid and gid of a file
+func ownerOf(info fs.FileInfo) (uint32, uint32, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return stat.Uid, stat.Gid, true
+}
@@ -0,0 +1,326 @@
+package archiver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+)
+
+// ManifestPath is the path of the manifest within every archive
+const ManifestPath = ".backmeup/manifest.json"
+
+// Version is the version of backmeup recorded in the manifests
+var Version = "dev"
+
+// Manifest describes the backup an archive was created by
+type Manifest struct {
+	Version    string         `json:"version"`
+	Unit       string         `json:"unit"`
+	Hostname   string         `json:"hostname,omitempty"`
+	StartTime  *time.Time     `json:"start_time,omitempty"`
+	EndTime    *time.Time     `json:"end_time,omitempty"`
+	ConfigHash string         `json:"config_hash"`
+	Sources    []string       `json:"sources"`
+	Excludes   []string       `json:"excludes"`
+	Files      []ManifestFile `json:"files"`
+}
+
+// ManifestFile describes a single entry of the archive
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Mode   string `json:"mode"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// newManifest creates the manifest of a backup without any files. The files are added by addFiles.
+// Reproducible archives contain neither the hostname nor any times.
+func newManifest(unit config.Unit) (*Manifest, error) {
+	configHash, err := unitHash(unit)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{
+		Version:    Version,
+		Unit:       unit.Name,
+		ConfigHash: configHash,
+		Sources:    manifestSources(unit),
+		Excludes:   unit.Excludes,
+		Files:      []ManifestFile{},
+	}
+
+	if manifest.Excludes == nil {
+		manifest.Excludes = []string{}
+	}
+
+	if !unit.Reproducible {
+		startTime := time.Now()
+		manifest.StartTime = &startTime
+		manifest.Hostname, _ = os.Hostname()
+	}
+
+	return manifest, nil
+}
+
+// addFiles hashes the given files up front, so the manifest can be the first entry of the archive. It returns the
+// files, which can be added to the archive. Each file in position i is described by m.Files[i] and regular files get
+// a content hash, which detects changes between hashing the file and writing it to the archive.
+func (m *Manifest) addFiles(files []BackupFileMetadata, unit config.Unit) []BackupFileMetadata {
+	if DEBUG {
+		log.Printf("Hashing %d files for the manifest", len(files))
+	}
+
+	hashedFiles := make([]BackupFileMetadata, 0, len(files))
+
+	for _, file := range files {
+		manifestFile, stat, err := newManifestFile(file, unit)
+		if err == nil && stat.Mode().IsRegular() {
+			manifestFile.SHA256, manifestFile.Size, err = hashFile(file.Path)
+			file.contentHash = newContentHash()
+		}
+
+		if err != nil {
+			log.Printf("Error while adding %s to the archive. %s", file.Path, err)
+			continue
+		}
+
+		m.Files = append(m.Files, manifestFile)
+		hashedFiles = append(hashedFiles, file)
+	}
+
+	return hashedFiles
+}
+
+// checkFiles logs a warning for every file, whose content in the archive differs from the hash in the manifest,
+// as it was modified while the backup was running. files are the files returned by addFiles.
+func (m *Manifest) checkFiles(files []BackupFileMetadata) {
+	for i, file := range files {
+		if file.contentHash == nil {
+			continue
+		}
+
+		// Files which could not be written completely have been logged by the archiver already
+		sum, _, complete := file.contentHash.sum()
+		if complete && sum != m.Files[i].SHA256 {
+			log.Printf("Warning: %s was modified while it was backed up, its hash in the manifest does not match the archive", file.Path)
+		}
+	}
+}
+
+// finish sets the end time of the backup, once all files are hashed
+func (m *Manifest) finish(unit config.Unit) {
+	if !unit.Reproducible {
+		endTime := time.Now()
+		m.EndTime = &endTime
+	}
+}
+
+// newManifestFile describes a single file without its hash. Followed symlinks are described by their target,
+// as the archive contains the content of the target.
+func newManifestFile(file BackupFileMetadata, unit config.Unit) (ManifestFile, fs.FileInfo, error) {
+	stat, err := os.Lstat(file.Path)
+	if err == nil && unit.FollowSymlinks && stat.Mode()&fs.ModeSymlink != 0 {
+		stat, err = os.Stat(file.Path)
+	}
+
+	if err != nil {
+		return ManifestFile{}, nil, err
+	}
+
+	manifestFile := ManifestFile{
+		Path: getPathInArchive(file.Path, file.BackupBasePath, unit),
+		Mode: stat.Mode().String(),
+	}
+
+	return manifestFile, stat, nil
+}
+
+// hashFile returns the SHA-256 hash and the size of the content of a file
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// contentHash hashes the content of a regular file while the archiver reads it. Archivers, which don't read
+// the content of an entry, like hard links in tar archives, link it to the hash of the file with the same content.
+type contentHash struct {
+	hash     hash.Hash
+	size     int64
+	complete bool
+	link     *contentHash
+}
+
+func newContentHash() *contentHash {
+	return &contentHash{hash: sha256.New()}
+}
+
+func (c *contentHash) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+
+	return c.hash.Write(p)
+}
+
+// tee returns a reader, which hashes all data read from r. It is safe to call on a nil contentHash.
+func (c *contentHash) tee(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+
+	return io.TeeReader(r, c)
+}
+
+// hole returns a reader without data, which adds size zero bytes to the hash once it is read.
+// It is used for the holes between the data regions of sparse files.
+func (c *contentHash) hole(size int64) io.Reader {
+	return &holeReader{content: c, size: size}
+}
+
+// finish marks the content as completely read. It is safe to call on a nil contentHash.
+func (c *contentHash) finish() {
+	if c != nil {
+		c.complete = true
+	}
+}
+
+// linkTo makes the content hash use the hash of another file with the same content
+func (c *contentHash) linkTo(other *contentHash) {
+	if c != nil {
+		c.link = other
+	}
+}
+
+// sum returns the hash and size of the content, if it was read completely
+func (c *contentHash) sum() (string, int64, bool) {
+	for c.link != nil {
+		c = c.link
+	}
+
+	if !c.complete {
+		return "", 0, false
+	}
+
+	return hex.EncodeToString(c.hash.Sum(nil)), c.size, true
+}
+
+// holeReader adds a hole of a sparse file to the content hash when it is read
+type holeReader struct {
+	content *contentHash
+	size    int64
+}
+
+func (h *holeReader) Read([]byte) (int, error) {
+	if h.content != nil && h.size > 0 {
+		if _, err := io.CopyN(h.content, zeroReader{}, h.size); err != nil {
+			return 0, err
+		}
+
+		h.size = 0
+	}
+
+	return 0, io.EOF
+}
+
+// zeroReader returns an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+// manifestSources returns the sources of a unit. Reproducible archives don't depend on the order of the sources,
+// so they are sorted.
+func manifestSources(unit config.Unit) []string {
+	if !unit.Reproducible {
+		return unit.Sources
+	}
+
+	sources := append([]string(nil), unit.Sources...)
+	sort.Strings(sources)
+
+	return sources
+}
+
+// unitHash returns the SHA-256 hash of the configuration of a unit. The hash of reproducible archives only covers
+// the options, which affect the content of the archive, so it is the same on every host.
+func unitHash(unit config.Unit) (string, error) {
+	if unit.Reproducible {
+		unit.Sources = manifestSources(unit)
+		unit.Destination = ""
+		unit.Enabled = false
+		unit.Workers = 0
+		unit.MemoryBudget = 0
+		unit.ManifestFile = false
+		unit.RecoveryPercent = 0
+		unit.PassphraseFile = ""
+		unit.PassphraseEnv = ""
+	}
+
+	data, err := json.Marshal(unit)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// Summary returns a single line describing the backup, which is used as zip archive comment
+func (m *Manifest) Summary() string {
+	totalSize := int64(0)
+	for _, file := range m.Files {
+		totalSize += file.Size
+	}
+
+	summary := fmt.Sprintf("backmeup %s, unit '%s'", m.Version, m.Unit)
+	if m.Hostname != "" {
+		summary += fmt.Sprintf(" on %s", m.Hostname)
+	}
+
+	if m.StartTime != nil {
+		summary += fmt.Sprintf(" at %s", m.StartTime.Format(time.RFC3339))
+	}
+
+	return summary + fmt.Sprintf(": %d files, %d bytes, config %.12s", len(m.Files), totalSize, m.ConfigHash)
+}
+
+// latestModTime returns the latest modification time of the given files, which is used
+// as modification time of the manifest in reproducible archives
+func latestModTime(files []BackupFileMetadata) time.Time {
+	latest := time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, file := range files {
+		if stat, err := os.Lstat(file.Path); err == nil && stat.ModTime().After(latest) {
+			latest = stat.ModTime()
+		}
+	}
+
+	return reproducibleModTime(latest)
+}
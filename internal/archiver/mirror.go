@@ -0,0 +1,450 @@
+package archiver
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+)
+
+// MirrorArchiveType is the archive type which copies the files into a snapshot directory instead of an archive
+const MirrorArchiveType = "mirror"
+
+// TimestampLayout is the layout of the timestamp in the names of archives and snapshots
+const TimestampLayout = "2006-01-02_15-04"
+
+// partialSuffix is appended to the name of a snapshot until all files are copied
+const partialSuffix = ".partial"
+
+// mirrorWriter copies files into a snapshot directory. Files which did not change since the previous snapshot
+// are hard linked against it, so each snapshot only costs the changed bytes.
+type mirrorWriter struct {
+	unit         config.Unit
+	snapshotPath string
+	// previousPath is the latest complete snapshot of the unit, or empty if there is none
+	previousPath string
+	// previousFiles are the files of the manifest of the previous snapshot by their path
+	previousFiles map[string]ManifestFile
+	// hardLinks maps files with multiple hard links to their first path within the snapshot
+	hardLinks map[fileID]string
+	// fileHashes holds the hash and size of the regular files of the snapshot by their path within the snapshot
+	fileHashes  map[string]ManifestFile
+	directories []restoredDirectory
+	linkCount   int
+	copyCount   int
+	copiedBytes int64
+}
+
+// writeMirror copies the files into a new snapshot directory at snapshotPath. The snapshot is written
+// to a temporary directory first, so incomplete snapshots are never used as previous snapshot.
+func writeMirror(snapshotPath string, filesToBackup []BackupFileMetadata, unit config.Unit) error {
+	manifest, err := newManifest(unit)
+	if err != nil {
+		return err
+	}
+
+	previousPath, err := previousSnapshot(filepath.Dir(snapshotPath), unit.Name)
+	if err != nil {
+		return err
+	}
+
+	if previousPath != "" {
+		log.Printf("Linking unchanged files against previous snapshot '%s'", previousPath)
+	}
+
+	m := &mirrorWriter{
+		unit:          unit,
+		snapshotPath:  snapshotPath + partialSuffix,
+		previousPath:  previousPath,
+		previousFiles: make(map[string]ManifestFile),
+		hardLinks:     make(map[fileID]string),
+		fileHashes:    make(map[string]ManifestFile),
+	}
+
+	if previousPath != "" {
+		if err := m.readPreviousManifest(); err != nil {
+			log.Printf("Can't read the manifest of the previous snapshot, linked files are hashed again. %s", err)
+		}
+	}
+
+	// Leftovers of an aborted run with the same name are discarded
+	if err := os.RemoveAll(m.snapshotPath); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(m.snapshotPath, 0o755); err != nil {
+		return err
+	}
+
+	bar := pb.New(len(filesToBackup))
+	bar.SetMaxWidth(100)
+	bar.Start()
+
+	for _, fileMetadata := range filesToBackup {
+		if err := m.addEntry(fileMetadata); err != nil {
+			log.Printf("Error while adding %s to the snapshot. %s", fileMetadata.Path, err)
+		} else if manifestFile, err := m.manifestFile(fileMetadata); err != nil {
+			log.Printf("Can't add '%s' to the manifest. %s", fileMetadata.Path, err)
+		} else {
+			manifest.Files = append(manifest.Files, manifestFile)
+		}
+
+		bar.Increment()
+	}
+
+	bar.Finish()
+	manifest.finish(unit)
+
+	// Directory metadata is set last, because adding their content changes their mtime
+	for i := len(m.directories) - 1; i >= 0; i-- {
+		restoreMetadata(m.directories[i].header, m.directories[i].path)
+	}
+
+	if err := m.writeManifest(manifest); err != nil {
+		os.RemoveAll(m.snapshotPath)
+
+		return err
+	}
+
+	if err := os.Rename(m.snapshotPath, snapshotPath); err != nil {
+		os.RemoveAll(m.snapshotPath)
+
+		return err
+	}
+
+	log.Printf("Hard linked %d unchanged files, copied %d files with %d bytes", m.linkCount, m.copyCount, m.copiedBytes)
+
+	return nil
+}
+
+// manifestFile describes a file of the snapshot for the manifest. Regular files are hashed while they are copied,
+// files linked against the previous snapshot take the hash from its manifest.
+func (m *mirrorWriter) manifestFile(fileMetadata BackupFileMetadata) (ManifestFile, error) {
+	manifestFile, stat, err := newManifestFile(fileMetadata, m.unit)
+	if err != nil || !stat.Mode().IsRegular() {
+		return manifestFile, err
+	}
+
+	entryPath, err := restorePath(m.snapshotPath, manifestFile.Path)
+	if err != nil {
+		return manifestFile, err
+	}
+
+	if hash, exists := m.fileHashes[entryPath]; exists {
+		manifestFile.SHA256, manifestFile.Size = hash.SHA256, hash.Size
+
+		return manifestFile, nil
+	}
+
+	// Files linked against a previous snapshot without usable manifest are hashed as they are stored
+	manifestFile.SHA256, manifestFile.Size, err = hashFile(entryPath)
+
+	return manifestFile, err
+}
+
+// readPreviousManifest reads the files of the manifest of the previous snapshot
+func (m *mirrorWriter) readPreviousManifest() error {
+	data, err := os.ReadFile(filepath.Join(m.previousPath, filepath.FromSlash(ManifestPath)))
+	if err != nil {
+		return err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return err
+	}
+
+	for _, file := range manifest.Files {
+		if file.SHA256 != "" {
+			m.previousFiles[file.Path] = file
+		}
+	}
+
+	return nil
+}
+
+// writeManifest writes the manifest into the snapshot. A snapshot without manifest is not complete.
+func (m *mirrorWriter) writeManifest(manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(m.snapshotPath, filepath.FromSlash(ManifestPath))
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(manifestPath, data, 0o644)
+}
+
+// addEntry copies a single file into the snapshot or links it against the previous snapshot
+func (m *mirrorWriter) addEntry(fileMetadata BackupFileMetadata) error {
+	pathInArchive := getPathInArchive(fileMetadata.Path, fileMetadata.BackupBasePath, m.unit)
+
+	entryPath, err := restorePath(m.snapshotPath, pathInArchive)
+	if err != nil {
+		return err
+	}
+
+	path := fileMetadata.Path
+
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	var linkTarget string
+	if stat.Mode()&os.ModeSymlink != 0 {
+		if m.unit.FollowSymlinks {
+			if stat, err = os.Stat(path); err != nil {
+				return err
+			}
+		} else if linkTarget, err = os.Readlink(path); err != nil {
+			return fmt.Errorf("%s: readlink: %v", stat.Name(), err)
+		}
+	}
+
+	header, err := tar.FileInfoHeader(stat, linkTarget)
+	if err != nil {
+		return err
+	}
+
+	header.Name = pathInArchive
+
+	if m.unit.PreserveXattrs {
+		if err := addXattrsToHeader(header, path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0o755); err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(entryPath, 0o700); err != nil {
+			return err
+		}
+
+		m.directories = append(m.directories, restoredDirectory{header: header, path: entryPath})
+
+		return nil
+	case tar.TypeSymlink:
+		if err := os.Symlink(linkTarget, entryPath); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		return m.addFile(path, stat, header, entryPath)
+	default:
+		if err := createSpecialFile(header, entryPath); err != nil {
+			return err
+		}
+	}
+
+	restoreMetadata(header, entryPath)
+
+	return nil
+}
+
+// addFile hard links the file against an earlier occurrence within the snapshot or against the previous snapshot.
+// Only changed files are copied.
+func (m *mirrorWriter) addFile(path string, stat fs.FileInfo, header *tar.Header, entryPath string) error {
+	id, isLinked := inodeOf(stat)
+	if isLinked {
+		if firstPath, exists := m.hardLinks[id]; exists {
+			if err := os.Link(firstPath, entryPath); err != nil {
+				return err
+			}
+
+			if hash, exists := m.fileHashes[firstPath]; exists {
+				m.fileHashes[entryPath] = hash
+			}
+
+			return nil
+		}
+	}
+
+	if err := m.linkOrCopyFile(path, stat, header, entryPath); err != nil {
+		return err
+	}
+
+	// Only files which were stored successfully can be linked by later occurrences
+	if isLinked {
+		m.hardLinks[id] = entryPath
+	}
+
+	return nil
+}
+
+// linkOrCopyFile hard links an unchanged file against the previous snapshot or copies it into the snapshot
+func (m *mirrorWriter) linkOrCopyFile(path string, stat fs.FileInfo, header *tar.Header, entryPath string) error {
+	if previousPath, unchanged := m.unchangedFile(header.Name, stat); unchanged {
+		err := os.Link(previousPath, entryPath)
+		if err == nil {
+			m.linkCount++
+
+			if previousFile, exists := m.previousFiles[header.Name]; exists {
+				m.fileHashes[entryPath] = previousFile
+			}
+
+			return nil
+		}
+
+		log.Printf("Can't link '%s' against the previous snapshot, copying it instead. %s", header.Name, err)
+	}
+
+	content := newContentHash()
+	if err := copyFile(path, entryPath, content); err != nil {
+		return err
+	}
+
+	sum, size, _ := content.sum()
+	m.fileHashes[entryPath] = ManifestFile{SHA256: sum, Size: size}
+
+	restoreMetadata(header, entryPath)
+
+	m.copyCount++
+	m.copiedBytes += stat.Size()
+
+	return nil
+}
+
+// unchangedFile returns the path of the file in the previous snapshot, if its size, modification time,
+// permissions and owner match the file. Linked files share their metadata, so all of them must match.
+func (m *mirrorWriter) unchangedFile(pathInArchive string, stat fs.FileInfo) (string, bool) {
+	if m.previousPath == "" {
+		return "", false
+	}
+
+	previousPath, err := restorePath(m.previousPath, pathInArchive)
+	if err != nil {
+		return "", false
+	}
+
+	previousStat, err := os.Lstat(previousPath)
+	if err != nil || !previousStat.Mode().IsRegular() {
+		return "", false
+	}
+
+	if previousStat.Size() != stat.Size() || !previousStat.ModTime().Equal(stat.ModTime()) || previousStat.Mode() != stat.Mode() {
+		return "", false
+	}
+
+	// The owner is only restored by root, so it is only compared in that case
+	if os.Geteuid() == 0 {
+		uid, gid, _ := ownerOf(stat)
+		previousUid, previousGid, _ := ownerOf(previousStat)
+
+		if uid != previousUid || gid != previousGid {
+			return "", false
+		}
+	}
+
+	return previousPath, true
+}
+
+// copyFile copies the content of a regular file to a new file at targetPath. The content is added to the given hash.
+func copyFile(path string, targetPath string, content *contentHash) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(targetPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(target, content.tee(source)); err != nil {
+		target.Close()
+
+		return err
+	}
+
+	content.finish()
+
+	return target.Close()
+}
+
+// previousSnapshot returns the path of the latest complete snapshot of the unit in the given directory
+func previousSnapshot(dirPath string, unitName string) (string, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return "", err
+	}
+
+	type snapshot struct {
+		path    string
+		time    time.Time
+		counter int
+	}
+
+	var snapshots []snapshot
+
+	for _, entry := range entries {
+		snapshotTime, counter, ok := parseSnapshotName(entry.Name(), unitName)
+		if !ok || !entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dirPath, entry.Name())
+		if _, err := os.Stat(filepath.Join(path, filepath.FromSlash(ManifestPath))); err != nil {
+			continue
+		}
+
+		snapshots = append(snapshots, snapshot{path: path, time: snapshotTime, counter: counter})
+	}
+
+	if len(snapshots) == 0 {
+		return "", nil
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].time.Equal(snapshots[j].time) {
+			return snapshots[i].time.Before(snapshots[j].time)
+		}
+
+		return snapshots[i].counter < snapshots[j].counter
+	})
+
+	return snapshots[len(snapshots)-1].path, nil
+}
+
+// parseSnapshotName returns the time and counter of a snapshot named <unit>-<timestamp> or <unit>-<timestamp>-<counter>
+func parseSnapshotName(name string, unitName string) (time.Time, int, bool) {
+	rest, hasPrefix := strings.CutPrefix(name, unitName+"-")
+	if !hasPrefix || len(rest) < len(TimestampLayout) {
+		return time.Time{}, 0, false
+	}
+
+	snapshotTime, err := time.Parse(TimestampLayout, rest[:len(TimestampLayout)])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	suffix := rest[len(TimestampLayout):]
+	if suffix == "" {
+		return snapshotTime, 0, true
+	}
+
+	counter, err := strconv.Atoi(strings.TrimPrefix(suffix, "-"))
+	if err != nil || !strings.HasPrefix(suffix, "-") {
+		return time.Time{}, 0, false
+	}
+
+	return snapshotTime, counter, true
+}
@@ -0,0 +1,162 @@
+package archiver
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+)
+
+// orderSampleSize is the maximum amount of data compressed to compare the entry orders
+const orderSampleSize = 32 << 20
+
+// OrderEntries returns the files in the given order. "walk" keeps the order of the directory walk, "path" sorts
+// by the path in the archive, "extension" groups files by their extension and then by name and "size" sorts by
+// file size. Ties are broken by the path in the archive, so every order except "walk" is deterministic.
+func OrderEntries(files []BackupFileMetadata, order string, unit config.Unit) []BackupFileMetadata {
+	if order == "walk" || order == "" {
+		return files
+	}
+
+	type entry struct {
+		file          BackupFileMetadata
+		pathInArchive string
+		extension     string
+		name          string
+		size          int64
+	}
+
+	entries := make([]entry, len(files))
+
+	for i, file := range files {
+		pathInArchive := getPathInArchive(file.Path, file.BackupBasePath, unit)
+		name := path.Base(strings.ReplaceAll(pathInArchive, "\\", "/"))
+		entries[i] = entry{file: file, pathInArchive: pathInArchive, name: name, extension: strings.ToLower(path.Ext(name))}
+
+		if order == "size" {
+			if stat, err := os.Lstat(file.Path); err == nil {
+				entries[i].size = stat.Size()
+			}
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+
+		switch {
+		case order == "extension" && a.extension != b.extension:
+			return a.extension < b.extension
+		case order == "extension" && a.name != b.name:
+			return a.name < b.name
+		case order == "size" && a.size != b.size:
+			return a.size < b.size
+		}
+
+		return a.pathInArchive < b.pathInArchive
+	})
+
+	ordered := make([]BackupFileMetadata, len(entries))
+	for i, entry := range entries {
+		ordered[i] = entry.file
+	}
+
+	return ordered
+}
+
+// CompareEntryOrders compresses a sample of the files in each entry order and returns
+// the compression ratio (compressed size / uncompressed size) of each order
+func CompareEntryOrders(files []BackupFileMetadata, unit config.Unit) (map[string]float64, error) {
+	sample := sampleFiles(files)
+	ratios := make(map[string]float64)
+
+	for _, order := range config.EntryOrders {
+		compressed, uncompressed, err := compressedSize(OrderEntries(sample, order, unit), unit)
+		if err != nil {
+			return nil, err
+		}
+
+		if uncompressed > 0 {
+			ratios[order] = float64(compressed) / float64(uncompressed)
+		}
+	}
+
+	return ratios, nil
+}
+
+// sampleFiles picks files spread over the whole list, until orderSampleSize is reached. A file is picked if the
+// sample stays within its share of the bytes of all files up to this file.
+func sampleFiles(files []BackupFileMetadata) []BackupFileMetadata {
+	var (
+		totalSize int64
+		sizes     = make([]int64, len(files))
+	)
+
+	for i, file := range files {
+		if stat, err := os.Lstat(file.Path); err == nil && stat.Mode().IsRegular() {
+			sizes[i] = stat.Size()
+			totalSize += stat.Size()
+		}
+	}
+
+	if totalSize <= orderSampleSize {
+		return files
+	}
+
+	share := float64(orderSampleSize) / float64(totalSize)
+
+	var (
+		sample      []BackupFileMetadata
+		sampleSize  int64
+		visitedSize int64
+	)
+
+	for i, file := range files {
+		visitedSize += sizes[i]
+
+		if sampleSize+sizes[i] > orderSampleSize || float64(sampleSize+sizes[i]) > share*float64(visitedSize) {
+			continue
+		}
+
+		sample = append(sample, file)
+		sampleSize += sizes[i]
+	}
+
+	return sample
+}
+
+// compressedSize writes the files into an archive which is discarded and returns its size and the size of the files
+func compressedSize(files []BackupFileMetadata, unit config.Unit) (int64, int64, error) {
+	// Encryption does not change the compressed size, but aes256 would ask for the password of zip archives
+	unit.Encryption = "none"
+
+	archiver, err := New(unit)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	output := &countingWriter{w: io.Discard}
+	if err := archiver.Open(output); err != nil {
+		return 0, 0, err
+	}
+
+	uncompressed := int64(0)
+
+	for _, file := range files {
+		if err := archiver.AddEntry(file); err != nil {
+			continue
+		}
+
+		if stat, err := os.Lstat(file.Path); err == nil && stat.Mode().IsRegular() {
+			uncompressed += stat.Size()
+		}
+	}
+
+	if err := archiver.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	return output.n, uncompressed, nil
+}
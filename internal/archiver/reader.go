@@ -0,0 +1,351 @@
+package archiver
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/d-Rickyy-b/backmeup/internal/bkperrors"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Reader iterates over the entries of an existing archive. Entries of all archive types are described by tar headers.
+type Reader interface {
+	// Next advances to the next entry of the archive and returns its header. At the end of the archive it returns io.EOF.
+	Next() (*tar.Header, error)
+	// Read reads the content of the current entry
+	Read(p []byte) (int, error)
+	// Close releases the resources of the reader. It does not close the underlying archive.
+	Close() error
+}
+
+// readerFactory creates a new Reader for the content of the given archive. Unless the archive is encrypted,
+// the content also implements randomAccess.
+type readerFactory func(archive io.Reader, keys Keys) (Reader, error)
+
+// randomAccess is implemented by archive content, which can be read at arbitrary offsets
+type randomAccess interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// readers maps the archive types to the factory of the corresponding Reader
+var readers = make(map[string]readerFactory)
+
+// registerReader makes a Reader available for archives of the given archive type
+func registerReader(archiveType string, factory readerFactory) {
+	readers[archiveType] = factory
+}
+
+func init() {
+	registerReader("tar", newTarReader(func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(r), nil }))
+	registerReader("tar.gz", newTarReader(newGzipDecompressor))
+	registerReader("tar.zst", newTarReader(newZstdDecompressor))
+	registerReader("tar.xz", newTarReader(func(r io.Reader) (io.ReadCloser, error) {
+		xr, err := xz.NewReader(r)
+		return io.NopCloser(xr), err
+	}))
+	registerReader("tar.bz2", newTarReader(func(r io.Reader) (io.ReadCloser, error) { return bzip2.NewReader(r, nil) }))
+	registerReader("tar.lz4", newTarReader(func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(lz4.NewReader(r)), nil }))
+	registerReader("zip", newZipReader)
+}
+
+// ArchiveTypeOf determines the archive type of an archive by its file name
+func ArchiveTypeOf(archivePath string) (string, error) {
+	archivePath, _ = cutVolumeSuffix(archivePath)
+	archivePath, _ = cutEncryptionSuffix(archivePath)
+	archiveType := ""
+
+	// Use the longest matching archive type, so that e.g. "tar.gz" is preferred over "gz"
+	for registeredType := range readers {
+		if strings.HasSuffix(archivePath, "."+registeredType) && len(registeredType) > len(archiveType) {
+			archiveType = registeredType
+		}
+	}
+
+	if archiveType == "" {
+		return "", fmt.Errorf("%w: can't determine the archive type of '%s'", bkperrors.ErrUnknownArchiveType, archivePath)
+	}
+
+	return archiveType, nil
+}
+
+// OpenReader opens the archive at the given path, which might be split into volumes, for reading.
+// Encrypted archives are decrypted with the given keys.
+// Closing the returned reader also closes the archive.
+func OpenReader(archivePath string, keys Keys) (Reader, error) {
+	archiveType, err := ArchiveTypeOf(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := openVolumeSet(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var content io.Reader = io.NewSectionReader(archive, 0, archive.Size())
+
+	if basePath, _ := cutVolumeSuffix(archivePath); strings.HasSuffix(basePath, AgeExtension) {
+		if content, err = decryptArchive(content, keys.Identities); err != nil {
+			archive.Close()
+			return nil, err
+		}
+	}
+
+	reader, err := readers[archiveType](content, keys)
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+
+	return &archiveReader{Reader: reader, archive: archive}, nil
+}
+
+// archiveReader closes the archive together with the Reader
+type archiveReader struct {
+	Reader
+	archive *volumeSet
+}
+
+func (r *archiveReader) Close() error {
+	readerErr := r.Reader.Close()
+	archiveErr := r.archive.Close()
+
+	if readerErr != nil {
+		return readerErr
+	}
+
+	return archiveErr
+}
+
+// decompressor wraps the given reader into a reader which decompresses the data read from it
+type decompressor func(r io.Reader) (io.ReadCloser, error)
+
+func newGzipDecompressor(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func newZstdDecompressor(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return decoder.IOReadCloser(), nil
+}
+
+// tarReader reads compressed tar archives
+type tarReader struct {
+	*tar.Reader
+	dr io.ReadCloser
+}
+
+func newTarReader(decompressor decompressor) readerFactory {
+	return func(archive io.Reader, _ Keys) (Reader, error) {
+		dr, err := decompressor(archive)
+		if err != nil {
+			return nil, err
+		}
+
+		return &tarReader{Reader: tar.NewReader(dr), dr: dr}, nil
+	}
+}
+
+func (r *tarReader) Close() error {
+	return r.dr.Close()
+}
+
+// zipReader reads zip archives
+type zipReader struct {
+	zr      *zip.Reader
+	index   int
+	current io.ReadCloser
+	// spillFile holds the content of archives, which can't be read at arbitrary offsets
+	spillFile *os.File
+	// password decrypts AES encrypted entries
+	password string
+}
+
+func newZipReader(archive io.Reader, keys Keys) (Reader, error) {
+	r := &zipReader{password: keys.Password}
+
+	content, isRandomAccess := archive.(randomAccess)
+	if !isRandomAccess {
+		// The central directory is at the end of zip archives, so decrypted archives are buffered on disk
+		spillFile, err := os.CreateTemp("", "backmeup-zip-*")
+		if err != nil {
+			return nil, err
+		}
+
+		r.spillFile = spillFile
+
+		size, err := io.Copy(spillFile, archive)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+
+		content = io.NewSectionReader(spillFile, 0, size)
+	}
+
+	zr, err := zip.NewReader(content, content.Size())
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	zr.RegisterDecompressor(zstd.ZipMethodWinZip, zstd.ZipDecompressor())
+	r.zr = zr
+
+	return r, nil
+}
+
+func (r *zipReader) Next() (*tar.Header, error) {
+	if err := r.closeCurrent(); err != nil {
+		return nil, err
+	}
+
+	if r.index >= len(r.zr.File) {
+		return nil, io.EOF
+	}
+
+	file := r.zr.File[r.index]
+	r.index++
+
+	header := &tar.Header{
+		Name:     file.Name,
+		Mode:     unixMode(file.Mode()),
+		Size:     int64(file.UncompressedSize64),
+		ModTime:  file.Modified,
+		Typeflag: tar.TypeReg,
+	}
+
+	header.Uid, header.Gid = zipOwner(file.Extra)
+
+	switch {
+	case file.Mode().IsDir():
+		header.Typeflag = tar.TypeDir
+	case file.Mode()&fs.ModeNamedPipe != 0:
+		header.Typeflag = tar.TypeFifo
+	case file.Mode()&fs.ModeCharDevice != 0:
+		header.Typeflag = tar.TypeChar
+	case file.Mode()&fs.ModeDevice != 0:
+		header.Typeflag = tar.TypeBlock
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		header.Size = 0
+
+		return header, nil
+	}
+
+	var current io.ReadCloser
+	var err error
+
+	if file.Method == winZipAESMethod {
+		current, err = openAESEntry(file, r.password)
+	} else {
+		current, err = file.Open()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.current = current
+
+	// Symlinks are stored with their target as content
+	if file.Mode()&fs.ModeSymlink != 0 {
+		target, err := io.ReadAll(current)
+		if err != nil {
+			return nil, err
+		}
+
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = string(target)
+		header.Size = 0
+	}
+
+	return header, nil
+}
+
+func (r *zipReader) Read(p []byte) (int, error) {
+	if r.current == nil {
+		return 0, io.EOF
+	}
+
+	return r.current.Read(p)
+}
+
+func (r *zipReader) closeCurrent() error {
+	if r.current == nil {
+		return nil
+	}
+
+	err := r.current.Close()
+	r.current = nil
+
+	return err
+}
+
+func (r *zipReader) Close() error {
+	if r.spillFile != nil {
+		r.spillFile.Close()
+		os.Remove(r.spillFile.Name())
+	}
+
+	return r.closeCurrent()
+}
+
+// unixMode converts the permissions of a file mode into the mode bits of a tar header
+func unixMode(mode fs.FileMode) int64 {
+	unixMode := int64(mode.Perm())
+
+	if mode&fs.ModeSetuid != 0 {
+		unixMode |= 0o4000
+	}
+
+	if mode&fs.ModeSetgid != 0 {
+		unixMode |= 0o2000
+	}
+
+	if mode&fs.ModeSticky != 0 {
+		unixMode |= 0o1000
+	}
+
+	return unixMode
+}
+
+// zipOwner returns uid and gid stored in the Info-ZIP unix extra field
+func zipOwner(extra []byte) (int, int) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+
+		if len(extra) < 4+size {
+			break
+		}
+
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		// Only uid and gid with a size of 4 bytes are supported, like written by the zipArchiver
+		if id != unixExtraID || size != 11 || field[0] != 1 || field[1] != 4 || field[6] != 4 {
+			continue
+		}
+
+		return int(binary.LittleEndian.Uint32(field[2:])), int(binary.LittleEndian.Uint32(field[7:]))
+	}
+
+	return 0, 0
+}
@@ -0,0 +1,387 @@
+package archiver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+
+	"github.com/d-Rickyy-b/backmeup/internal/bkperrors"
+	"github.com/klauspost/reedsolomon"
+)
+
+// recoveryMagic identifies recovery files and the version of their format
+const recoveryMagic = "BKMREC1\n"
+
+// recoveryBlockSize is the maximum size of the blocks the archive is split into. Corruption is detected and
+// repaired per block.
+const recoveryBlockSize = 64 << 10
+
+// recoveryMinBlockSize is the minimum size of the blocks. Block sizes are always a multiple of it.
+const recoveryMinBlockSize = 64
+
+// recoveryDataShards is the maximum number of consecutive archive blocks protected by the same recovery blocks
+const recoveryDataShards = 128
+
+// crcTable is used for the checksums of the blocks
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// recoveryHeader is stored at the beginning of a recovery file. It is followed by one record per segment
+// of recoveryDataShards archive blocks, holding the checksums of all blocks and the recovery blocks.
+type recoveryHeader struct {
+	BlockSize    uint32
+	DataShards   uint32
+	ParityShards uint32
+	ArchiveSize  uint64
+	// Checksum is the SHA-256 checksum of the whole archive
+	Checksum [sha256.Size]byte
+}
+
+// segmentSize returns the amount of archive data in a segment
+func (h recoveryHeader) segmentSize() int64 {
+	return int64(h.BlockSize) * int64(h.DataShards)
+}
+
+// recoveryPath returns the path of the recovery file of an archive
+func recoveryPath(archivePath string) string {
+	archivePath, _ = cutVolumeSuffix(archivePath)
+
+	return archivePath + ".rec"
+}
+
+// writeRecoveryFile creates a recovery file for the archive with the given redundancy in percent.
+// Each segment of the archive can be repaired, as long as no more of its blocks are corrupted than
+// it has recovery blocks.
+func writeRecoveryFile(archivePath string, percent int) error {
+	archive, err := openVolumeSet(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	header := newRecoveryHeader(archive.Size(), percent)
+
+	encoder, err := reedsolomon.New(int(header.DataShards), int(header.ParityShards))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(recoveryPath(archivePath))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The header is written last, once the checksum of the archive is known
+	headerSize := int64(len(recoveryMagic) + binary.Size(header) + 4)
+	if _, err := file.Seek(headerSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(file)
+	archiveHash := sha256.New()
+	shards := newShards(header)
+
+	for offset := int64(0); offset < archive.Size(); offset += header.segmentSize() {
+		if _, err := readSegment(archive, offset, shards[:header.DataShards], archiveHash); err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(shards); err != nil {
+			return err
+		}
+
+		for _, shard := range shards {
+			if err := binary.Write(bw, binary.LittleEndian, crc32.Checksum(shard, crcTable)); err != nil {
+				return err
+			}
+		}
+
+		for _, shard := range shards[header.DataShards:] {
+			if _, err := bw.Write(shard); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	copy(header.Checksum[:], archiveHash.Sum(nil))
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := file.Write(encodeRecoveryHeader(header)); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// newRecoveryHeader chooses the block size and the number of blocks per segment for an archive of the given size.
+// The archive is split into segments of equal size, which are no larger than necessary. Small archives use smaller
+// and fewer blocks, so the size of the recovery file stays close to the percentage of the archive size.
+func newRecoveryHeader(size int64, percent int) recoveryHeader {
+	maxSegmentSize := int64(recoveryBlockSize) * recoveryDataShards
+
+	segments := (size + maxSegmentSize - 1) / maxSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+
+	segmentSize := (size + segments - 1) / segments
+
+	blockSize := (segmentSize + recoveryDataShards - 1) / recoveryDataShards
+	blockSize = (blockSize + recoveryMinBlockSize - 1) / recoveryMinBlockSize * recoveryMinBlockSize
+	if blockSize == 0 {
+		blockSize = recoveryMinBlockSize
+	}
+
+	dataShards := (segmentSize + blockSize - 1) / blockSize
+	if dataShards == 0 {
+		dataShards = 1
+	}
+
+	return recoveryHeader{
+		BlockSize:    uint32(blockSize),
+		DataShards:   uint32(dataShards),
+		ParityShards: uint32((int(dataShards)*percent + 99) / 100),
+		ArchiveSize:  uint64(size),
+	}
+}
+
+// newShards allocates the buffers for the data and recovery blocks of a segment
+func newShards(header recoveryHeader) [][]byte {
+	shards := make([][]byte, header.DataShards+header.ParityShards)
+	for i := range shards {
+		shards[i] = make([]byte, header.BlockSize)
+	}
+
+	return shards
+}
+
+// readSegment reads the blocks of the segment at the given offset into the shards and returns the amount of
+// data read. Blocks behind the end of the archive are filled with zeros.
+func readSegment(archive io.ReaderAt, offset int64, shards [][]byte, archiveHash hash.Hash) (int64, error) {
+	total := int64(0)
+
+	for i, shard := range shards {
+		n, err := archive.ReadAt(shard, offset+int64(i)*int64(len(shard)))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return total, err
+		}
+
+		copy(shard[n:], make([]byte, len(shard)-n))
+
+		if archiveHash != nil {
+			archiveHash.Write(shard[:n])
+		}
+
+		total += int64(n)
+	}
+
+	return total, nil
+}
+
+// encodeRecoveryHeader returns the magic, the header and the checksum of both
+func encodeRecoveryHeader(header recoveryHeader) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(recoveryMagic)
+	binary.Write(&buffer, binary.LittleEndian, header)
+	binary.Write(&buffer, binary.LittleEndian, crc32.Checksum(buffer.Bytes(), crcTable))
+
+	return buffer.Bytes()
+}
+
+// readRecoveryHeader reads and verifies the header of a recovery file
+func readRecoveryHeader(r io.Reader) (recoveryHeader, error) {
+	var header recoveryHeader
+
+	data := make([]byte, len(recoveryMagic)+binary.Size(header)+4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return header, fmt.Errorf("reading recovery file header: %w", err)
+	}
+
+	if string(data[:len(recoveryMagic)]) != recoveryMagic {
+		return header, errors.New("not a recovery file of backmeup")
+	}
+
+	checksum := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(data[:len(data)-4], crcTable) != checksum {
+		return header, fmt.Errorf("%w: the header of the recovery file is corrupted", bkperrors.ErrUnrepairable)
+	}
+
+	if err := binary.Read(bytes.NewReader(data[len(recoveryMagic):]), binary.LittleEndian, &header); err != nil {
+		return header, err
+	}
+
+	if header.BlockSize == 0 || header.DataShards == 0 || header.ParityShards == 0 {
+		return header, errors.New("invalid recovery file header")
+	}
+
+	return header, nil
+}
+
+// Repair checks all blocks of the archive against its recovery file and repairs corrupted blocks in place.
+// Truncated archives, which are not split into volumes, are restored to their original size.
+func Repair(archivePath string) error {
+	recoveryFile, err := os.Open(recoveryPath(archivePath))
+	if err != nil {
+		return err
+	}
+	defer recoveryFile.Close()
+
+	recovery := bufio.NewReader(recoveryFile)
+
+	header, err := readRecoveryHeader(recovery)
+	if err != nil {
+		return err
+	}
+
+	encoder, err := reedsolomon.New(int(header.DataShards), int(header.ParityShards))
+	if err != nil {
+		return err
+	}
+
+	archive, err := openVolumeSetFlag(archivePath, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	if err := restoreArchiveSize(archive, int64(header.ArchiveSize)); err != nil {
+		return err
+	}
+
+	archiveHash := sha256.New()
+	shards := newShards(header)
+	checksums := make([]uint32, header.DataShards+header.ParityShards)
+	repaired, unrepairable := 0, 0
+
+	for offset := int64(0); offset < archive.Size(); offset += header.segmentSize() {
+		if err := binary.Read(recovery, binary.LittleEndian, checksums); err != nil {
+			return fmt.Errorf("reading recovery file: %w", err)
+		}
+
+		for _, shard := range shards[header.DataShards:] {
+			if _, err := io.ReadFull(recovery, shard); err != nil {
+				return fmt.Errorf("reading recovery file: %w", err)
+			}
+		}
+
+		segmentSize, err := readSegment(archive, offset, shards[:header.DataShards], nil)
+		if err != nil {
+			return err
+		}
+
+		// Corrupted blocks are missing for the reconstruction. This includes corrupted recovery blocks.
+		var corrupted []int
+		for i, shard := range shards {
+			if shard != nil && crc32.Checksum(shard, crcTable) != checksums[i] {
+				shards[i] = nil
+
+				if i < int(header.DataShards) {
+					corrupted = append(corrupted, i)
+				}
+			}
+		}
+
+		if len(corrupted) > 0 {
+			if err := encoder.ReconstructData(shards); err != nil {
+				log.Printf("Can't repair %d corrupted blocks at offset %d. %s", len(corrupted), offset, err)
+				unrepairable += len(corrupted)
+			} else if err := writeRepairedBlocks(archive, offset, shards, corrupted); err != nil {
+				return err
+			} else {
+				repaired += len(corrupted)
+			}
+		}
+
+		for i := range shards {
+			if shards[i] == nil {
+				shards[i] = make([]byte, header.BlockSize)
+			}
+		}
+
+		for _, shard := range shards[:header.DataShards] {
+			length := blockLength(segmentSize, len(shard))
+			archiveHash.Write(shard[:length])
+			segmentSize -= int64(length)
+		}
+	}
+
+	if unrepairable > 0 {
+		return fmt.Errorf("%w: repaired %d blocks, %d blocks are still corrupted", bkperrors.ErrUnrepairable, repaired, unrepairable)
+	}
+
+	if !bytes.Equal(archiveHash.Sum(nil), header.Checksum[:]) {
+		return fmt.Errorf("%w: the checksum of the archive does not match after repairing %d blocks", bkperrors.ErrUnrepairable, repaired)
+	}
+
+	if repaired == 0 {
+		log.Printf("Archive '%s' is intact", archivePath)
+	} else {
+		log.Printf("Repaired %d corrupted blocks of archive '%s'", repaired, archivePath)
+	}
+
+	return nil
+}
+
+// writeRepairedBlocks writes the reconstructed blocks back into the archive
+func writeRepairedBlocks(archive *volumeSet, offset int64, shards [][]byte, corrupted []int) error {
+	for _, i := range corrupted {
+		blockOffset := offset + int64(i)*int64(len(shards[i]))
+		length := blockLength(archive.Size()-blockOffset, len(shards[i]))
+
+		if _, err := archive.WriteAt(shards[i][:length], blockOffset); err != nil {
+			return fmt.Errorf("writing repaired block at offset %d: %w", blockOffset, err)
+		}
+	}
+
+	return nil
+}
+
+// blockLength returns the amount of archive data in a block, given the amount of data remaining from its start
+func blockLength(remaining int64, blockSize int) int {
+	if remaining < 0 {
+		return 0
+	}
+
+	if remaining < int64(blockSize) {
+		return int(remaining)
+	}
+
+	return blockSize
+}
+
+// restoreArchiveSize extends or truncates an archive to its original size. The missing data is repaired afterwards.
+func restoreArchiveSize(archive *volumeSet, size int64) error {
+	if archive.Size() == size {
+		return nil
+	}
+
+	if len(archive.files) != 1 {
+		return fmt.Errorf("%w: the size of the volumes changed", bkperrors.ErrUnrepairable)
+	}
+
+	log.Printf("Archive has a size of %d bytes instead of %d bytes, restoring its size", archive.Size(), size)
+
+	if err := archive.files[0].Truncate(size); err != nil {
+		return err
+	}
+
+	archive.sizes[0] = size
+	archive.size = size
+
+	return nil
+}
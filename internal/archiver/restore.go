@@ -0,0 +1,342 @@
+package archiver
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// List writes a listing of all entries of the given archive to w. The headers of seekable archives
+// are read via the seek index, without decompressing the content of the entries.
+func List(archivePath string, w io.Writer, keys Keys) error {
+	seekable, err := openSeekableArchive(archivePath)
+	if err != nil {
+		return err
+	}
+
+	if seekable != nil {
+		defer seekable.Close()
+
+		return listSeekable(seekable, w)
+	}
+
+	reader, err := OpenReader(archivePath, keys)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		writeListEntry(w, header)
+	}
+}
+
+// writeListEntry writes a single line describing the entry to w
+func writeListEntry(w io.Writer, header *tar.Header) {
+	name := header.Name
+	if header.Linkname != "" {
+		name = fmt.Sprintf("%s -> %s", name, header.Linkname)
+	}
+
+	fmt.Fprintf(w, "%s %12d %s %s\n", header.FileInfo().Mode(), header.Size, header.ModTime.Format("2006-01-02 15:04"), name)
+}
+
+// Restore extracts all entries of the given archive into the target directory.
+// Encrypted archives are decrypted with the given keys.
+func Restore(archivePath string, targetPath string, keys Keys) error {
+	return restoreEntries(archivePath, targetPath, func(string) bool { return true }, nil, keys)
+}
+
+// restoreEntries extracts the entries of the given archive, whose name is accepted by the filter, into the target directory.
+// linkedFiles maps files which are not accepted by the filter to the first accepted hard link to them, as returned
+// by filteredLinkTargets. Their content is restored at the path of that link instead.
+func restoreEntries(archivePath string, targetPath string, filter func(name string) bool, linkedFiles map[string]string, keys Keys) error {
+	reader, err := OpenReader(archivePath, keys)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Directory metadata is set last, because restoring their content changes their mtime
+	// and restrictive permissions could prevent writing their content at all
+	var directories []restoredDirectory
+	defer func() {
+		for i := len(directories) - 1; i >= 0; i-- {
+			restoreMetadata(directories[i].header, directories[i].path)
+		}
+	}()
+
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// The manifest describes the archive itself and is not part of the backed up files
+		if header.Name == ManifestPath {
+			continue
+		}
+
+		if !filter(header.Name) {
+			firstLink, isLinked := linkedFiles[header.Name]
+			if !isLinked || header.Typeflag != tar.TypeReg {
+				continue
+			}
+
+			// The content of the linked file is restored as its first hard link, which the other links point to
+			header.Name = firstLink
+		} else if header.Typeflag == tar.TypeLink {
+			if firstLink, isLinked := linkedFiles[header.Linkname]; isLinked {
+				if firstLink == header.Name {
+					continue
+				}
+
+				header.Linkname = firstLink
+			}
+		}
+
+		entryPath, err := restorePath(targetPath, header.Name)
+		if err != nil {
+			log.Printf("Skipping entry '%s': %s", header.Name, err)
+			continue
+		}
+
+		if err := restoreEntry(reader, header, targetPath, entryPath); err != nil {
+			log.Printf("Error while restoring '%s'. %s", header.Name, err)
+		} else if header.Typeflag == tar.TypeDir {
+			directories = append(directories, restoredDirectory{header: header, path: entryPath})
+		}
+	}
+}
+
+// filteredLinkTargets returns the files, which are not accepted by the filter but are the target of an accepted
+// hard link, mapped to the first accepted link. The archive is read once more to find them, because the linked
+// file is stored before its links.
+func filteredLinkTargets(archivePath string, filter func(name string) bool, keys Keys) (map[string]string, error) {
+	reader, err := OpenReader(archivePath, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	linkedFiles := make(map[string]string)
+
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return linkedFiles, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeLink || !filter(header.Name) || filter(header.Linkname) {
+			continue
+		}
+
+		if _, exists := linkedFiles[header.Linkname]; !exists {
+			linkedFiles[header.Linkname] = header.Name
+		}
+	}
+}
+
+// restoredDirectory is a directory whose metadata is set after all entries are restored
+type restoredDirectory struct {
+	header *tar.Header
+	path   string
+}
+
+// restorePath returns the path an entry is restored to. Absolute paths in the archive are
+// restored relative to the target directory and entries must not escape the target directory.
+func restorePath(targetPath string, name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+
+	// Remove drive letters of Windows paths such as C:/Users
+	if len(name) >= 2 && name[1] == ':' {
+		name = name[2:]
+	}
+
+	cleanName := filepath.Clean(filepath.FromSlash(strings.TrimLeft(name, "/")))
+	if cleanName == "." || cleanName == ".." || strings.HasPrefix(cleanName, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path in archive")
+	}
+
+	return filepath.Join(targetPath, cleanName), nil
+}
+
+// checkParents makes sure that no parent directory of the entry within the target directory is a symlink.
+// Otherwise an entry could be written outside of the target directory through a symlink restored earlier.
+func checkParents(targetPath string, entryPath string) error {
+	relativePath, err := filepath.Rel(targetPath, filepath.Dir(entryPath))
+	if err != nil || relativePath == "." {
+		return err
+	}
+
+	currentPath := targetPath
+	for _, component := range strings.Split(relativePath, string(filepath.Separator)) {
+		currentPath = filepath.Join(currentPath, component)
+
+		stat, err := os.Lstat(currentPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if stat.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("parent directory '%s' is a symlink", currentPath)
+		}
+	}
+
+	return nil
+}
+
+// checkLinkTarget rejects absolute symlink targets and relative ones pointing outside of the target directory
+func checkLinkTarget(targetPath string, entryPath string, linkname string) error {
+	linkname = filepath.FromSlash(linkname)
+	if filepath.IsAbs(linkname) || filepath.VolumeName(linkname) != "" || strings.HasPrefix(linkname, string(filepath.Separator)) {
+		return fmt.Errorf("absolute link target '%s'", linkname)
+	}
+
+	relativePath, err := filepath.Rel(targetPath, filepath.Join(filepath.Dir(entryPath), linkname))
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("link target '%s' is outside of the target directory", linkname)
+	}
+
+	return nil
+}
+
+// restoreEntry writes a single entry of the archive to the given path
+func restoreEntry(reader io.Reader, header *tar.Header, targetPath string, entryPath string) error {
+	mode := header.FileInfo().Mode()
+
+	if err := checkParents(targetPath, entryPath); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0o755); err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if stat, err := os.Lstat(entryPath); err == nil && stat.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("directory '%s' is a symlink", entryPath)
+		}
+
+		// Its metadata is restored after its content
+		return os.MkdirAll(entryPath, 0o700)
+	case tar.TypeSymlink:
+		if err := checkLinkTarget(targetPath, entryPath, header.Linkname); err != nil {
+			return err
+		}
+
+		os.Remove(entryPath)
+
+		if err := os.Symlink(header.Linkname, entryPath); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linkPath, err := restorePath(targetPath, header.Linkname)
+		if err != nil {
+			return err
+		}
+
+		if err := checkParents(targetPath, linkPath); err != nil {
+			return err
+		}
+
+		os.Remove(entryPath)
+
+		// The link shares metadata and extended attributes with the already restored file
+		return os.Link(linkPath, entryPath)
+	case tar.TypeReg:
+		// Symlinks are never followed, so the content can't end up outside of the target directory
+		file, err := os.OpenFile(entryPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|noFollowFlag, mode.Perm())
+		if err != nil {
+			return err
+		}
+
+		if header.PAXRecords[paxSparseMajor] != "" {
+			err = restoreSparse(file, reader, header.Size)
+		} else {
+			_, err = io.Copy(file, reader)
+		}
+
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		if err := file.Close(); err != nil {
+			return err
+		}
+	case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+		os.Remove(entryPath)
+
+		if err := createSpecialFile(header, entryPath); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported entry type '%c'", header.Typeflag)
+	}
+
+	restoreMetadata(header, entryPath)
+
+	return nil
+}
+
+// restoreMetadata restores owner, permissions, extended attributes and modification time of an entry
+func restoreMetadata(header *tar.Header, entryPath string) {
+	// Only root is allowed to hand files to other users
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(entryPath, header.Uid, header.Gid); err != nil {
+			log.Printf("Can't restore owner of '%s'. %s", header.Name, err)
+		}
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		restoreXattrs(header, entryPath)
+		return
+	}
+
+	// Changing the owner clears setuid and setgid bits, so permissions are restored afterwards
+	if err := os.Chmod(entryPath, header.FileInfo().Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		log.Printf("Can't restore permissions of '%s'. %s", header.Name, err)
+	}
+
+	// Extended attributes are applied after writing the content, because writing clears file capabilities
+	restoreXattrs(header, entryPath)
+
+	if err := os.Chtimes(entryPath, header.ModTime, header.ModTime); err != nil {
+		log.Printf("Can't restore modification time of '%s'. %s", header.Name, err)
+	}
+}
+
+// restoreXattrs applies the extended attributes stored in the PAX records of the header
+func restoreXattrs(header *tar.Header, entryPath string) {
+	for key, value := range header.PAXRecords {
+		name, isXattr := strings.CutPrefix(key, paxXattrPrefix)
+		if !isXattr {
+			continue
+		}
+
+		if err := writeXattr(entryPath, name, []byte(value)); err != nil {
+			log.Printf("Can't restore extended attribute '%s' of '%s'. %s", name, header.Name, err)
+		}
+	}
+}
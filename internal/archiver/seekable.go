@@ -0,0 +1,395 @@
+package archiver
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+)
+
+// seekableBlockSize is the minimum amount of uncompressed data in a block of a seekable archive.
+// Smaller blocks make seeking more precise, but compress worse.
+const seekableBlockSize = 1 << 20
+
+// seekIndexVersion is the version of the format of the seek index
+const seekIndexVersion = 1
+
+// seekableDecompressors contains the decompressors of the archive types which can be written as seekable archives.
+// Gzip members and zstd frames are independent, so decompression can start at the beginning of each of them.
+var seekableDecompressors = map[string]decompressor{
+	"tar.gz":  newGzipDecompressor,
+	"tar.zst": newZstdDecompressor,
+}
+
+// seekIndex maps the entries of a seekable archive to the compressed block they start in
+type seekIndex struct {
+	Version int          `json:"version"`
+	Entries []indexEntry `json:"entries"`
+}
+
+// indexEntry locates the header of a single entry within a seekable archive
+type indexEntry struct {
+	Name string `json:"name"`
+	// Offset is the position of the compressed block within the archive
+	Offset int64 `json:"offset"`
+	// Skip is the amount of decompressed bytes in front of the header within the block
+	Skip int64 `json:"skip"`
+}
+
+// indexPath returns the path of the seek index of an archive
+func indexPath(archivePath string) string {
+	archivePath, _ = cutVolumeSuffix(archivePath)
+
+	return archivePath + ".index"
+}
+
+// seekableWriter compresses the stream in independent blocks. A new block is only started at the beginning
+// of an entry, once the current block holds at least seekableBlockSize bytes.
+type seekableWriter struct {
+	unit       config.Unit
+	compressor compressor
+	out        *countingWriter
+	cw         io.WriteCloser
+	blockStart int64
+	blockSize  int64
+	index      seekIndex
+}
+
+func newSeekableWriter(w io.Writer, compressor compressor, unit config.Unit) (*seekableWriter, error) {
+	s := &seekableWriter{
+		unit:       unit,
+		compressor: compressor,
+		out:        &countingWriter{w: w},
+		index:      seekIndex{Version: seekIndexVersion},
+	}
+
+	cw, err := compressor(s.out, unit)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cw = cw
+
+	return s, nil
+}
+
+func (s *seekableWriter) Write(p []byte) (int, error) {
+	n, err := s.cw.Write(p)
+	s.blockSize += int64(n)
+
+	return n, err
+}
+
+// startEntry adds the entry, whose header is written next, to the index
+func (s *seekableWriter) startEntry(name string) error {
+	if s.blockSize >= seekableBlockSize {
+		if err := s.cw.Close(); err != nil {
+			return err
+		}
+
+		cw, err := s.compressor(s.out, s.unit)
+		if err != nil {
+			return err
+		}
+
+		s.cw = cw
+		s.blockStart = s.out.n
+		s.blockSize = 0
+	}
+
+	s.index.Entries = append(s.index.Entries, indexEntry{Name: name, Offset: s.blockStart, Skip: s.blockSize})
+
+	return nil
+}
+
+func (s *seekableWriter) Close() error {
+	return s.cw.Close()
+}
+
+// writeSeekIndex writes the index of a seekable archive next to the archive
+func writeSeekIndex(archivePath string, index *seekIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(indexPath(archivePath), data, 0o644); err != nil {
+		return fmt.Errorf("writing seek index: %w", err)
+	}
+
+	return nil
+}
+
+// readSeekIndex reads the index of a seekable archive. It returns nil, if the archive has no index.
+func readSeekIndex(archivePath string) (*seekIndex, error) {
+	data, err := os.ReadFile(indexPath(archivePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var index seekIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("parsing seek index: %w", err)
+	}
+
+	if index.Version != seekIndexVersion {
+		return nil, fmt.Errorf("unsupported seek index version %d", index.Version)
+	}
+
+	return &index, nil
+}
+
+// seekableArchive reads single entries of a seekable archive without decompressing the entries in front of them
+type seekableArchive struct {
+	archive      *volumeSet
+	decompressor decompressor
+	index        *seekIndex
+	// current decompresses the block at currentOffset. Following entries of the same block are read from it.
+	current       io.ReadCloser
+	currentOffset int64
+	position      *countingReader
+}
+
+// openSeekableArchive opens the archive for random access. It returns nil, if the archive has no seek index.
+func openSeekableArchive(archivePath string) (*seekableArchive, error) {
+	archiveType, err := ArchiveTypeOf(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Encrypted archives can't be read at arbitrary offsets
+	basePath, _ := cutVolumeSuffix(archivePath)
+
+	decompressor, isSeekable := seekableDecompressors[archiveType]
+	if !isSeekable || strings.HasSuffix(basePath, AgeExtension) {
+		return nil, nil
+	}
+
+	index, err := readSeekIndex(archivePath)
+	if err != nil || index == nil {
+		return nil, err
+	}
+
+	archive, err := openVolumeSet(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &seekableArchive{archive: archive, decompressor: decompressor, index: index}, nil
+}
+
+// entry returns the header of the given index entry and a reader for its content, which is valid until
+// the next call of entry
+func (s *seekableArchive) entry(entry indexEntry) (*tar.Header, io.Reader, error) {
+	if s.current == nil || entry.Offset != s.currentOffset || entry.Skip < s.position.n {
+		if err := s.openBlock(entry.Offset); err != nil {
+			return nil, nil, fmt.Errorf("seeking to entry '%s': %w", entry.Name, err)
+		}
+	}
+
+	if _, err := io.CopyN(io.Discard, s.position, entry.Skip-s.position.n); err != nil {
+		return nil, nil, fmt.Errorf("seeking to entry '%s': %w", entry.Name, err)
+	}
+
+	// tar.Reader does not read ahead, so the position stays exact
+	tr := tar.NewReader(s.position)
+
+	header, err := tr.Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading entry '%s': %w", entry.Name, err)
+	}
+
+	if header.Name != entry.Name {
+		return nil, nil, fmt.Errorf("seek index does not match the archive: found '%s' instead of '%s'", header.Name, entry.Name)
+	}
+
+	return header, tr, nil
+}
+
+// openBlock starts decompressing the block at the given offset of the archive
+func (s *seekableArchive) openBlock(offset int64) error {
+	if err := s.closeCurrent(); err != nil {
+		return err
+	}
+
+	if offset < 0 || offset > s.archive.Size() {
+		return fmt.Errorf("invalid offset %d in seek index", offset)
+	}
+
+	dr, err := s.decompressor(bufio.NewReader(io.NewSectionReader(s.archive, offset, s.archive.Size()-offset)))
+	if err != nil {
+		return err
+	}
+
+	s.current = dr
+	s.currentOffset = offset
+	s.position = &countingReader{r: dr}
+
+	return nil
+}
+
+// find returns the index entry of the entry with the given name
+func (s *seekableArchive) find(name string) (indexEntry, bool) {
+	for _, entry := range s.index.Entries {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+
+	return indexEntry{}, false
+}
+
+func (s *seekableArchive) closeCurrent() error {
+	if s.current == nil {
+		return nil
+	}
+
+	err := s.current.Close()
+	s.current = nil
+
+	return err
+}
+
+func (s *seekableArchive) Close() error {
+	currentErr := s.closeCurrent()
+	archiveErr := s.archive.Close()
+
+	if currentErr != nil {
+		return currentErr
+	}
+
+	return archiveErr
+}
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// matchesEntryName checks if the entry is one of the given names or within one of the given directories
+func matchesEntryName(entryName string, names []string) bool {
+	entryName = strings.TrimSuffix(entryName, "/")
+
+	for _, name := range names {
+		name = strings.TrimSuffix(path.Clean(strings.ReplaceAll(name, "\\", "/")), "/")
+
+		if entryName == name || strings.HasPrefix(entryName, name+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Extract restores the entries with the given names, including the content of directories, into the target directory.
+// Seekable archives are read at the position of each entry, all other archives are read from the start.
+func Extract(archivePath string, targetPath string, names []string, keys Keys) error {
+	seekable, err := openSeekableArchive(archivePath)
+	if err != nil {
+		return err
+	}
+
+	if seekable == nil {
+		filter := func(name string) bool { return matchesEntryName(name, names) }
+
+		// Hard links to files which are not extracted are replaced by the content of the linked file
+		linkedFiles, err := filteredLinkTargets(archivePath, filter, keys)
+		if err != nil {
+			return err
+		}
+
+		return restoreEntries(archivePath, targetPath, filter, linkedFiles, keys)
+	}
+	defer seekable.Close()
+
+	var directories []restoredDirectory
+	defer func() {
+		for i := len(directories) - 1; i >= 0; i-- {
+			restoreMetadata(directories[i].header, directories[i].path)
+		}
+	}()
+
+	extracted := make(map[string]bool)
+	found := 0
+
+	for _, entry := range seekable.index.Entries {
+		if entry.Name == ManifestPath || !matchesEntryName(entry.Name, names) {
+			continue
+		}
+
+		found++
+
+		header, content, err := seekable.entry(entry)
+		if err != nil {
+			return err
+		}
+
+		entryPath, err := restorePath(targetPath, header.Name)
+		if err != nil {
+			log.Printf("Skipping entry '%s': %s", header.Name, err)
+			continue
+		}
+
+		// Hard links to files which are not extracted are replaced by the content of the linked file
+		if header.Typeflag == tar.TypeLink && !extracted[header.Linkname] {
+			linkedEntry, exists := seekable.find(header.Linkname)
+			if !exists {
+				log.Printf("Skipping entry '%s': linked file '%s' is not in the archive", header.Name, header.Linkname)
+				continue
+			}
+
+			if header, content, err = seekable.entry(linkedEntry); err != nil {
+				return err
+			}
+		}
+
+		if err := restoreEntry(content, header, targetPath, entryPath); err != nil {
+			log.Printf("Error while restoring '%s'. %s", header.Name, err)
+			continue
+		}
+
+		extracted[entry.Name] = true
+
+		if header.Typeflag == tar.TypeDir {
+			directories = append(directories, restoredDirectory{header: header, path: entryPath})
+		}
+	}
+
+	if found == 0 {
+		return fmt.Errorf("no entry matching %s found in the archive", strings.Join(names, ", "))
+	}
+
+	return nil
+}
+
+// listSeekable lists the entries of a seekable archive by reading their headers only
+func listSeekable(seekable *seekableArchive, w io.Writer) error {
+	for _, entry := range seekable.index.Entries {
+		header, _, err := seekable.entry(entry)
+		if err != nil {
+			return err
+		}
+
+		writeListEntry(w, header)
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package archiver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+)
+
+// checksumPath returns the path of the checksum file of an archive
+func checksumPath(archivePath string) string {
+	return archivePath + ".sha256"
+}
+
+// manifestFilePath returns the path of the manifest file of an archive, e.g. name.manifest.json for name.tar.gz
+func manifestFilePath(archivePath string, unit config.Unit) string {
+	archivePath, _ = cutEncryptionSuffix(archivePath)
+
+	return strings.TrimSuffix(archivePath, "."+unit.ArchiveType) + ".manifest.json"
+}
+
+// writeSidecarFiles writes the checksum file and, if enabled, the manifest file next to the archive.
+// The checksum file uses the format of sha256sum, so copies can be verified via "sha256sum -c".
+func writeSidecarFiles(archivePath string, checksums []fileChecksum, manifest *Manifest, unit config.Unit) error {
+	if len(checksums) == 0 {
+		return nil
+	}
+
+	var sb strings.Builder
+	for _, checksum := range checksums {
+		fmt.Fprintf(&sb, "%s  %s\n", hex.EncodeToString(checksum.sum), filepath.Base(checksum.path))
+	}
+
+	if err := os.WriteFile(checksumPath(archivePath), []byte(sb.String()), 0o644); err != nil {
+		return fmt.Errorf("writing checksum file: %w", err)
+	}
+
+	if !unit.ManifestFile {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(manifestFilePath(archivePath, unit), data, 0o644); err != nil {
+		return fmt.Errorf("writing manifest file: %w", err)
+	}
+
+	return nil
+}
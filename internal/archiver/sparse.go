@@ -0,0 +1,224 @@
+package archiver
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+const (
+	tarBlockSize = 512
+	// paxSparseMajor marks entries written in the PAX 1.0 sparse format of GNU tar
+	paxSparseMajor = "GNU.sparse.major"
+	// sparseChunkSize is the granularity in which zero runs are turned into holes on restore
+	sparseChunkSize = 4096
+)
+
+// sparseRegion is a region of a sparse file which contains data
+type sparseRegion struct {
+	offset int64
+	length int64
+}
+
+// writeSparseEntry writes a regular file as PAX 1.0 sparse entry, which only contains the data regions of the file.
+// archive/tar can read such entries but does not support writing them, so the headers are written directly.
+func (a *tarArchiver) writeSparseEntry(header *tar.Header, file *os.File, regions []sparseRegion, content *contentHash) error {
+	// The sparse map is stored in front of the data, padded to a full block
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(regions))
+
+	dataSize := int64(0)
+	for _, region := range regions {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", region.offset, region.length)
+		dataSize += region.length
+	}
+
+	sparseMap.Write(make([]byte, padding(int64(sparseMap.Len()))))
+	storedSize := int64(sparseMap.Len()) + dataSize
+
+	records := map[string]string{
+		paxSparseMajor:        "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     header.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(header.Size, 10),
+		"mtime":               strconv.FormatInt(header.ModTime.Unix(), 10),
+		"size":                strconv.FormatInt(storedSize, 10),
+		"uid":                 strconv.Itoa(header.Uid),
+		"gid":                 strconv.Itoa(header.Gid),
+		"uname":               header.Uname,
+		"gname":               header.Gname,
+	}
+	for key, value := range header.PAXRecords {
+		records[key] = value
+	}
+
+	keys := make([]string, 0, len(records))
+	for key, value := range records {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	var paxData bytes.Buffer
+	for _, key := range keys {
+		paxData.WriteString(formatPAXRecord(key, records[key]))
+	}
+
+	// Finish the padding of the previous entry before writing to the underlying stream
+	if err := a.tw.Flush(); err != nil {
+		return err
+	}
+
+	if err := a.startEntry(header.Name); err != nil {
+		return err
+	}
+
+	dir, name := path.Split(header.Name)
+
+	paxHeader := *header
+	paxHeader.Mode = 0o644
+	if err := writeRawTarBlock(a.cw, path.Join(dir, "PaxHeaders.0", name), tar.TypeXHeader, int64(paxData.Len()), &paxHeader); err != nil {
+		return err
+	}
+
+	if err := writePadded(a.cw, &paxData, int64(paxData.Len())); err != nil {
+		return err
+	}
+
+	if err := writeRawTarBlock(a.cw, path.Join(dir, "GNUSparseFile.0", name), tar.TypeReg, storedSize, header); err != nil {
+		return err
+	}
+
+	if _, err := a.cw.Write(sparseMap.Bytes()); err != nil {
+		return err
+	}
+
+	// The holes are added to the content hash as zeros, so it matches the hash of the restored file
+	readers := make([]io.Reader, 0, 2*len(regions))
+	end := int64(0)
+	for _, region := range regions {
+		readers = append(readers, content.hole(region.offset-end), content.tee(io.NewSectionReader(file, region.offset, region.length)))
+		end = region.offset + region.length
+	}
+
+	if err := writePadded(a.cw, io.MultiReader(readers...), dataSize); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(io.Discard, content.hole(header.Size-end)); err != nil {
+		return err
+	}
+
+	content.finish()
+
+	return nil
+}
+
+// writePadded copies exactly size bytes and pads them to a full tar block
+func writePadded(w io.Writer, r io.Reader, size int64) error {
+	written, err := io.Copy(w, io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+
+	if written != size {
+		return fmt.Errorf("file changed while reading: got %d bytes instead of %d", written, size)
+	}
+
+	_, err = w.Write(make([]byte, padding(size)))
+
+	return err
+}
+
+// padding returns the number of bytes needed to fill up the last tar block
+func padding(size int64) int64 {
+	return -size & (tarBlockSize - 1)
+}
+
+// formatPAXRecord formats a single PAX record. Its length prefix includes the length of the prefix itself.
+func formatPAXRecord(key string, value string) string {
+	record := " " + key + "=" + value + "\n"
+	size := len(record) + len(strconv.Itoa(len(record)))
+
+	if len(strconv.Itoa(size)) > len(strconv.Itoa(len(record))) {
+		size++
+	}
+
+	return strconv.Itoa(size) + record
+}
+
+// writeRawTarBlock writes a ustar header block. Values which don't fit into their fields are expected
+// to be provided by a preceding PAX header and are zeroed or truncated.
+func writeRawTarBlock(w io.Writer, name string, typeflag byte, size int64, header *tar.Header) error {
+	var block [tarBlockSize]byte
+
+	copy(block[0:100], name)
+	formatOctal(block[100:108], header.Mode&0o7777)
+	formatOctal(block[108:116], int64(header.Uid))
+	formatOctal(block[116:124], int64(header.Gid))
+	formatOctal(block[124:136], size)
+	formatOctal(block[136:148], header.ModTime.Unix())
+	block[156] = typeflag
+	copy(block[257:263], "ustar\x00")
+	copy(block[263:265], "00")
+	copy(block[265:297], header.Uname)
+	copy(block[297:329], header.Gname)
+
+	// The checksum is calculated with the checksum field filled with spaces
+	copy(block[148:156], "        ")
+
+	checksum := int64(0)
+	for _, b := range block {
+		checksum += int64(b)
+	}
+
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", checksum))
+
+	_, err := w.Write(block[:])
+
+	return err
+}
+
+// formatOctal writes a NUL terminated octal number into the field, or zeroes if it doesn't fit
+func formatOctal(field []byte, value int64) {
+	if value < 0 || len(strconv.FormatInt(value, 8)) > len(field)-1 {
+		value = 0
+	}
+
+	copy(field, fmt.Sprintf("%0*o\x00", len(field)-1, value))
+}
+
+// restoreSparse writes the content of a sparse entry and turns runs of zeroes back into holes
+func restoreSparse(file *os.File, r io.Reader, size int64) error {
+	chunk := make([]byte, sparseChunkSize)
+	zeroes := make([]byte, sparseChunkSize)
+
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if bytes.Equal(chunk[:n], zeroes[:n]) {
+				if _, seekErr := file.Seek(int64(n), io.SeekCurrent); seekErr != nil {
+					return seekErr
+				}
+			} else if _, writeErr := file.Write(chunk[:n]); writeErr != nil {
+				return writeErr
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	// Trailing holes are only created by setting the size of the file
+	return file.Truncate(size)
+}
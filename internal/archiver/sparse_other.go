@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package archiver
+
+import (
+	"io/fs"
+	"os"
+)
+
+// dataRegions returns nil, because holes can't be detected on this platform
+func dataRegions(_ *os.File, _ fs.FileInfo) ([]sparseRegion, error) {
+	return nil, nil
+}
@@ -0,0 +1,67 @@
+//go:build linux || darwin
+
+package archiver
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataRegions returns the data regions of a sparse file using SEEK_DATA and SEEK_HOLE.
+// It returns nil for files without holes or if the file system can't report them.
+func dataRegions(file *os.File, info fs.FileInfo) ([]sparseRegion, error) {
+	// Files which occupy at least their apparent size on disk can't contain holes
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Blocks*512 >= info.Size() {
+		return nil, nil
+	}
+
+	var regions []sparseRegion
+
+	size := info.Size()
+	offset := int64(0)
+
+	for offset < size {
+		dataStart, err := file.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// No more data up to the end of the file
+			break
+		} else if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		dataEnd, err := file.Seek(dataStart, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+
+		if dataEnd > size {
+			dataEnd = size
+		}
+
+		regions = append(regions, sparseRegion{offset: dataStart, length: dataEnd - dataStart})
+		offset = dataEnd
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	// Compressed file systems occupy fewer blocks than the apparent size of files without holes
+	if len(regions) == 1 && regions[0].offset == 0 && regions[0].length == size {
+		return nil, nil
+	}
+
+	// A trailing empty region records the size of files ending with a hole, just like GNU tar does
+	if len(regions) == 0 || regions[len(regions)-1].offset+regions[len(regions)-1].length < size {
+		regions = append(regions, sparseRegion{offset: size, length: 0})
+	}
+
+	return regions, nil
+}
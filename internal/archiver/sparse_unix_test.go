@@ -0,0 +1,39 @@
+//go:build linux || darwin
+
+package archiver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// compressedFileInfo reports fewer blocks than needed for the size of the file, like compressed file systems do
+type compressedFileInfo struct {
+	os.FileInfo
+	stat syscall.Stat_t
+}
+
+func (c *compressedFileInfo) Sys() any {
+	return &c.stat
+}
+
+func TestDataRegionsWithoutHoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dense.txt")
+	if err := os.WriteFile(path, []byte(strings.Repeat("data", 4096)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := &compressedFileInfo{FileInfo: mustStat(t, path), stat: syscall.Stat_t{Blocks: 1}}
+
+	regions, err := dataRegions(mustOpen(t, path), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if regions != nil {
+		t.Fatalf("File without holes is stored as sparse file with regions %v", regions)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package archiver
+
+import (
+	"archive/tar"
+	"fmt"
+)
+
+// noFollowFlag is not supported on this platform, parent directories are checked for symlinks instead
+const noFollowFlag = 0
+
+// createSpecialFile returns an error, because FIFOs and device files can't be created on this platform
+func createSpecialFile(header *tar.Header, _ string) error {
+	return fmt.Errorf("entry type '%c' is not supported on this platform", header.Typeflag)
+}
@@ -0,0 +1,27 @@
+//go:build linux || darwin
+
+package archiver
+
+import (
+	"archive/tar"
+
+	"golang.org/x/sys/unix"
+)
+
+// noFollowFlag makes opening a file fail, if it is a symlink
+const noFollowFlag = unix.O_NOFOLLOW
+
+// createSpecialFile creates a FIFO or device file. Creating device files requires root permissions.
+func createSpecialFile(header *tar.Header, path string) error {
+	mode := uint32(header.Mode & 0o7777)
+	switch header.Typeflag {
+	case tar.TypeFifo:
+		mode |= unix.S_IFIFO
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	}
+
+	return unix.Mknod(path, mode, int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))))
+}
@@ -0,0 +1,329 @@
+package archiver
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+)
+
+// paxXattrPrefix is the prefix of PAX records holding extended attributes, as used by GNU tar and star
+const paxXattrPrefix = "SCHILY.xattr."
+
+// fileID identifies a file by its device and inode
+type fileID struct {
+	device uint64
+	inode  uint64
+}
+
+// hardLink is the first entry of a file with multiple hard links, which later occurrences link to
+type hardLink struct {
+	path    string
+	content *contentHash
+}
+
+// tarFormats maps the values of the tar_format option to the header formats. With "auto", tar.Writer picks
+// the format of each entry on its own.
+var tarFormats = map[string]tar.Format{
+	"ustar": tar.FormatUSTAR,
+	"pax":   tar.FormatPAX,
+	"gnu":   tar.FormatGNU,
+}
+
+// tarArchiver writes tar archives, which are compressed by the configured compressor
+type tarArchiver struct {
+	unit       config.Unit
+	compressor compressor
+	cw         io.WriteCloser
+	tw         *tar.Writer
+	// hardLinks maps files with multiple hard links to their first entry in the archive
+	hardLinks  map[fileID]hardLink
+	linkCount  int
+	savedBytes int64
+	// seekable compresses the archive in independent blocks, if the unit is seekable
+	seekable *seekableWriter
+}
+
+// newTarArchiver returns a Factory for tar archives compressed with the given compressor
+func newTarArchiver(compressor compressor) Factory {
+	return func(unit config.Unit) Archiver {
+		return &tarArchiver{unit: unit, compressor: compressor}
+	}
+}
+
+func (a *tarArchiver) Open(w io.Writer) error {
+	if a.unit.PreserveXattrs && !xattrsSupported {
+		log.Printf("Extended attributes can't be preserved on this platform!")
+	}
+
+	// set up the compressor and tar writer
+	if a.unit.Seekable {
+		seekable, err := newSeekableWriter(w, a.compressor, a.unit)
+		if err != nil {
+			return err
+		}
+
+		a.seekable = seekable
+		a.cw = seekable
+	} else {
+		cw, err := a.compressor(w, a.unit)
+		if err != nil {
+			return err
+		}
+
+		a.cw = cw
+	}
+	a.tw = tar.NewWriter(a.cw)
+	a.hardLinks = make(map[fileID]hardLink)
+
+	return nil
+}
+
+func (a *tarArchiver) AddEntry(fileMetadata BackupFileMetadata) error {
+	pathInArchive := getPathInArchive(fileMetadata.Path, fileMetadata.BackupBasePath, a.unit)
+
+	return a.addFileToTar(fileMetadata.Path, pathInArchive, fileMetadata.contentHash)
+}
+
+func (a *tarArchiver) AddContent(pathInArchive string, content []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     pathInArchive,
+		Mode:     0o644,
+		Size:     int64(len(content)),
+		ModTime:  modTime,
+	}
+
+	if err := a.writeHeader(header); err != nil {
+		return err
+	}
+
+	_, err := a.tw.Write(content)
+
+	return err
+}
+
+func (a *tarArchiver) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+
+	if a.linkCount > 0 {
+		log.Printf("Stored %d hard links as link entries, saved %d bytes", a.linkCount, a.savedBytes)
+	}
+
+	return a.cw.Close()
+}
+
+// addFileToTar writes a single file to the archive. The content of regular files is added to the given hash,
+// which may be nil.
+func (a *tarArchiver) addFileToTar(path string, pathInArchive string, content *contentHash) error {
+	stat, statErr := os.Lstat(path)
+	if statErr != nil {
+		return statErr
+	}
+	var linkTarget string
+	// Check if file is symlink
+	if stat.Mode()&os.ModeSymlink != 0 {
+		var err error
+		linkTarget, err = os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("%s: readlink: %v", stat.Name(), err)
+		}
+
+		// In case the user wants to follow symlinks we eval the symlink target
+		if a.unit.FollowSymlinks {
+			linkTargetPath, evalSymlinkErr := filepath.EvalSymlinks(path)
+			if evalSymlinkErr != nil {
+				return evalSymlinkErr
+			}
+
+			linkTargetInfo, linkTargetStatErr := os.Stat(linkTargetPath)
+			if linkTargetStatErr != nil {
+				log.Printf("Can't access link target!")
+				return linkTargetStatErr
+			}
+
+			// The symlink is replaced by the actual file. Linked directories are stored as directory entries,
+			// their content is added by the walker.
+			path = linkTargetPath
+			linkTarget = ""
+			stat = linkTargetInfo
+		}
+	}
+
+	// now lets create the header as needed for this file within the tarball
+	header, err := tar.FileInfoHeader(stat, filepath.ToSlash(linkTarget))
+	if err != nil {
+		return err
+	}
+
+	header.Name = pathInArchive
+	if header.Typeflag == tar.TypeDir && !strings.HasSuffix(header.Name, "/") {
+		header.Name += "/"
+	}
+
+	// Reproducible archives only contain metadata which does not depend on the host or the time of the backup
+	if a.unit.Reproducible {
+		header.ModTime = reproducibleModTime(header.ModTime)
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+	}
+
+	// Later occurrences of a hard linked file are stored as links to the first one. The first one is only
+	// registered once it was written, as links to an entry missing from the archive can't be extracted.
+	id, isLinked := inodeOf(stat)
+	isLinked = isLinked && stat.Mode().IsRegular()
+
+	if first, exists := a.hardLinks[id]; isLinked && exists {
+		header.Typeflag = tar.TypeLink
+		header.Linkname = first.path
+		header.Size = 0
+		a.linkCount++
+		a.savedBytes += stat.Size()
+		content.linkTo(first.content)
+	}
+
+	if a.unit.PreserveXattrs {
+		if err := addXattrsToHeader(header, path); err != nil {
+			return err
+		}
+	}
+
+	if err := a.writeFileEntry(header, path, stat, content); err != nil {
+		return err
+	}
+
+	if _, exists := a.hardLinks[id]; isLinked && !exists {
+		a.hardLinks[id] = hardLink{path: pathInArchive, content: content}
+	}
+
+	return nil
+}
+
+// writeFileEntry writes the header and the content of a file to the archive
+func (a *tarArchiver) writeFileEntry(header *tar.Header, path string, stat os.FileInfo, content *contentHash) error {
+	// Only regular files are opened, opening a FIFO would block until something writes to it
+	if header.Typeflag != tar.TypeReg {
+		return a.writeHeader(header)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Sparse files are stored with their data regions only. This requires PAX headers.
+	if format, forced := tarFormats[a.unit.TarFormat]; !forced || format == tar.FormatPAX {
+		regions, err := dataRegions(file, stat)
+		if err != nil {
+			return fmt.Errorf("%s: detecting holes: %w", file.Name(), err)
+		}
+
+		if regions != nil {
+			return a.writeSparseEntry(header, file, regions, content)
+		}
+	}
+
+	// write the header to the tarball archiver
+	if err := a.writeHeader(header); err != nil {
+		return err
+	}
+
+	// copy the file data to the tarball
+	if _, err := io.Copy(a.tw, content.tee(file)); err != nil {
+		return fmt.Errorf("%s: copying contents: %w", file.Name(), err)
+	}
+
+	content.finish()
+
+	return nil
+}
+
+// writeHeader writes the header in the configured tar format. Headers which can't be represented
+// in that format are written in the format chosen by tar.Writer, which is PAX or GNU then.
+func (a *tarArchiver) writeHeader(header *tar.Header) error {
+	if err := a.startEntry(header.Name); err != nil {
+		return err
+	}
+
+	format, forced := tarFormats[a.unit.TarFormat]
+	if !forced {
+		return a.tw.WriteHeader(header)
+	}
+
+	// Only PAX headers hold sub-second timestamps, USTAR headers not even access and change times
+	if a.unit.TimestampPrecision != "nanosecond" || format == tar.FormatUSTAR {
+		header.ModTime = header.ModTime.Truncate(time.Second)
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+	}
+
+	header.Format = format
+
+	err := a.tw.WriteHeader(header)
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("Entry '%s' can't be stored in %s format, falling back to PAX or GNU format. %s", header.Name, strings.ToUpper(a.unit.TarFormat), err)
+
+	header.Format = tar.FormatUnknown
+
+	return a.tw.WriteHeader(header)
+}
+
+// startEntry finishes the previous entry and, for seekable archives, adds the next entry to the seek index
+func (a *tarArchiver) startEntry(name string) error {
+	if a.seekable == nil {
+		return nil
+	}
+
+	if err := a.tw.Flush(); err != nil {
+		return err
+	}
+
+	return a.seekable.startEntry(name)
+}
+
+// seekIndex returns the seek index of seekable archives, once the archive is closed
+func (a *tarArchiver) seekIndex() *seekIndex {
+	if a.seekable == nil {
+		return nil
+	}
+
+	return &a.seekable.index
+}
+
+// addXattrsToHeader stores the extended attributes of the given file as PAX records in the header
+func addXattrsToHeader(header *tar.Header, path string) error {
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return fmt.Errorf("%s: reading extended attributes: %w", path, err)
+	}
+
+	if len(xattrs) == 0 {
+		return nil
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+
+	for name, value := range xattrs {
+		header.PAXRecords[paxXattrPrefix+name] = string(value)
+	}
+
+	header.Format = tar.FormatPAX
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package archiver
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// volumePath returns the path of the volume with the given (1-based) index
+func volumePath(archivePath string, index int) string {
+	return fmt.Sprintf("%s.%03d", archivePath, index)
+}
+
+// ArchiveExists checks if an archive exists at the given path, either as single file or split into volumes
+func ArchiveExists(archivePath string) bool {
+	for _, path := range []string{archivePath, volumePath(archivePath, 1)} {
+		if _, err := os.Stat(path); err == nil || !os.IsNotExist(err) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// volumeWriter splits the archive into volumes of a fixed size named <archive>.001, <archive>.002, ...
+type volumeWriter struct {
+	archivePath string
+	volumeSize  int64
+	current     *os.File
+	written     int64
+	paths       []string
+	hash        hash.Hash
+	checksums   []fileChecksum
+}
+
+func newVolumeWriter(archivePath string, volumeSize int64) *volumeWriter {
+	return &volumeWriter{archivePath: archivePath, volumeSize: volumeSize}
+}
+
+func (v *volumeWriter) Write(p []byte) (int, error) {
+	total := 0
+
+	for len(p) > 0 {
+		if v.current == nil || v.written >= v.volumeSize {
+			if err := v.nextVolume(); err != nil {
+				return total, err
+			}
+		}
+
+		chunk := p
+		if remaining := v.volumeSize - v.written; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		n, err := v.current.Write(chunk)
+		v.hash.Write(chunk[:n])
+		total += n
+		v.written += int64(n)
+
+		if err != nil {
+			return total, err
+		}
+
+		p = p[n:]
+	}
+
+	return total, nil
+}
+
+// nextVolume closes the current volume and creates the next one
+func (v *volumeWriter) nextVolume() error {
+	if err := v.Close(); err != nil {
+		return err
+	}
+
+	path := volumePath(v.archivePath, len(v.paths)+1)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	v.current = file
+	v.written = 0
+	v.paths = append(v.paths, path)
+	v.hash = sha256.New()
+
+	return nil
+}
+
+func (v *volumeWriter) Close() error {
+	if v.current == nil {
+		return nil
+	}
+
+	err := v.current.Close()
+	v.checksums = append(v.checksums, fileChecksum{path: v.current.Name(), sum: v.hash.Sum(nil)})
+	v.current = nil
+
+	return err
+}
+
+// Checksums returns the checksums of all volumes
+func (v *volumeWriter) Checksums() []fileChecksum {
+	return v.checksums
+}
+
+// Remove deletes all volumes written so far
+func (v *volumeWriter) Remove() {
+	v.Close()
+
+	for _, path := range v.paths {
+		os.Remove(path)
+	}
+}
+
+// volumeSet provides read access to an archive, which is either a single file or split into volumes
+type volumeSet struct {
+	files   []*os.File
+	offsets []int64 // offsets of the volumes within the archive
+	sizes   []int64
+	size    int64
+}
+
+// openVolumeSet opens the archive at the given path. The path may point to the archive itself,
+// to its first volume (archive.tar.gz.001) or to the archive name without volume suffix.
+func openVolumeSet(archivePath string) (*volumeSet, error) {
+	return openVolumeSetFlag(archivePath, os.O_RDONLY)
+}
+
+// openVolumeSetFlag opens the archive with the given flag, e.g. os.O_RDWR for repairing it
+func openVolumeSetFlag(archivePath string, flag int) (*volumeSet, error) {
+	paths := []string{archivePath}
+
+	if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+		paths = findVolumes(archivePath)
+	} else if basePath, isVolume := cutVolumeSuffix(archivePath); isVolume {
+		paths = findVolumes(basePath)
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("archive '%s' does not exist", archivePath)
+	}
+
+	set := &volumeSet{}
+
+	for _, path := range paths {
+		file, err := os.OpenFile(path, flag, 0)
+		if err != nil {
+			set.Close()
+			return nil, err
+		}
+
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			set.Close()
+
+			return nil, err
+		}
+
+		set.files = append(set.files, file)
+		set.offsets = append(set.offsets, set.size)
+		set.sizes = append(set.sizes, stat.Size())
+		set.size += stat.Size()
+	}
+
+	return set, nil
+}
+
+// findVolumes returns the paths of all consecutive volumes of the given archive
+func findVolumes(archivePath string) []string {
+	var paths []string
+
+	for index := 1; ; index++ {
+		path := volumePath(archivePath, index)
+		if _, err := os.Stat(path); err != nil {
+			return paths
+		}
+
+		paths = append(paths, path)
+	}
+}
+
+// cutVolumeSuffix removes a volume suffix such as .001 from the given path
+func cutVolumeSuffix(path string) (string, bool) {
+	if len(path) < 4 || path[len(path)-4] != '.' {
+		return path, false
+	}
+
+	for _, c := range path[len(path)-3:] {
+		if c < '0' || c > '9' {
+			return path, false
+		}
+	}
+
+	return path[:len(path)-4], true
+}
+
+// ReadAt reads from the archive at the given offset, crossing volume boundaries if necessary
+func (s *volumeSet) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+
+	for i, file := range s.files {
+		volumeEnd := s.offsets[i] + s.sizes[i]
+		if len(p) == 0 || off >= volumeEnd {
+			continue
+		}
+
+		chunk := p
+		if remaining := volumeEnd - off; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		n, err := file.ReadAt(chunk, off-s.offsets[i])
+		total += n
+		off += int64(n)
+		p = p[n:]
+
+		if err != nil && !errors.Is(err, io.EOF) {
+			return total, err
+		}
+	}
+
+	if len(p) > 0 {
+		return total, io.EOF
+	}
+
+	return total, nil
+}
+
+// WriteAt writes to the volumes at the given offset of the archive. It can't write beyond the end of the archive.
+func (s *volumeSet) WriteAt(p []byte, off int64) (int, error) {
+	total := 0
+
+	for i, file := range s.files {
+		volumeEnd := s.offsets[i] + s.sizes[i]
+		if len(p) == 0 || off >= volumeEnd {
+			continue
+		}
+
+		chunk := p
+		if remaining := volumeEnd - off; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		n, err := file.WriteAt(chunk, off-s.offsets[i])
+		total += n
+		off += int64(n)
+		p = p[n:]
+
+		if err != nil {
+			return total, err
+		}
+	}
+
+	if len(p) > 0 {
+		return total, io.ErrShortWrite
+	}
+
+	return total, nil
+}
+
+// Size returns the size of the whole archive
+func (s *volumeSet) Size() int64 {
+	return s.size
+}
+
+func (s *volumeSet) Close() error {
+	var closeErr error
+
+	for _, file := range s.files {
+		if err := file.Close(); err != nil {
+			closeErr = err
+		}
+	}
+
+	return closeErr
+}
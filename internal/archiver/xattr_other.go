@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package archiver
+
+import "errors"
+
+// xattrsSupported tells if extended attributes can be read and written on this platform
+const xattrsSupported = false
+
+func readXattrs(_ string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattr(_ string, _ string, _ []byte) error {
+	return errors.New("extended attributes are not supported on this platform")
+}
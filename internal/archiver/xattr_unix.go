@@ -0,0 +1,76 @@
+//go:build linux || darwin
+
+package archiver
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrsSupported tells if extended attributes can be read and written on this platform
+const xattrsSupported = true
+
+// readXattrs returns all extended attributes of the given file without following symlinks.
+// This includes POSIX ACLs (system.posix_acl_*), SELinux labels and file capabilities (security.*).
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+
+	names := make([]byte, size)
+
+	size, err = unix.Llistxattr(path, names)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		value, err := readXattr(path, string(name))
+		if err != nil {
+			return nil, err
+		}
+
+		xattrs[string(name)] = value
+	}
+
+	return xattrs, nil
+}
+
+// readXattr returns the value of a single extended attribute
+func readXattr(path string, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, size)
+
+	size, err = unix.Lgetxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return value[:size], nil
+}
+
+// writeXattr sets an extended attribute of the given file without following symlinks
+func writeXattr(path string, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
@@ -0,0 +1,366 @@
+package archiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	zipVersion20   = 20     // zip version 2.0, which CreateHeader uses for regular entries
+	extTimeExtraID = 0x5455 // extended timestamp extra field of Info-ZIP
+	unixExtraID    = 0x7875 // Info-ZIP new unix extra field with uid and gid
+)
+
+// zipArchiver writes zip archives. The compression method is chosen per entry. With more than one worker,
+// the entries are compressed in parallel and written in order afterwards.
+type zipArchiver struct {
+	unit config.Unit
+	zw   *zip.Writer
+
+	budget     *memoryBudget
+	jobs       chan *zipJob
+	pending    chan *zipJob
+	workers    sync.WaitGroup
+	writerDone chan struct{}
+	writeErr   error
+	comment    string
+	// password encrypts the entries with AES-256, if it is set
+	password string
+}
+
+func newZipArchiver(unit config.Unit) Archiver {
+	return &zipArchiver{unit: unit}
+}
+
+func (a *zipArchiver) Open(w io.Writer) error {
+	level := a.unit.CompressionLevel
+	if level < config.DefaultCompressionLevel || level > flate.BestCompression {
+		return fmt.Errorf("invalid zip compression level %d (valid: 0-9)", level)
+	}
+
+	if a.unit.PreserveXattrs {
+		log.Printf("Extended attributes can only be preserved in tar archives!")
+	}
+
+	if a.unit.Encryption == "aes256" {
+		password, err := zipPassword(a.unit.Name, a.unit.PassphraseFile, a.unit.PassphraseEnv)
+		if err != nil {
+			return fmt.Errorf("setting up encryption: %w", err)
+		}
+
+		a.password = password
+	}
+
+	a.zw = zip.NewWriter(w)
+
+	if workerCount(a.unit) > 1 {
+		a.startWorkers()
+	}
+
+	return nil
+}
+
+func (a *zipArchiver) AddEntry(fileMetadata BackupFileMetadata) error {
+	pathInArchive := getPathInArchive(fileMetadata.Path, fileMetadata.BackupBasePath, a.unit)
+
+	if a.jobs != nil {
+		return a.queueFile(fileMetadata.Path, pathInArchive, fileMetadata.contentHash)
+	}
+
+	return a.addFileToZip(fileMetadata.Path, pathInArchive, fileMetadata.contentHash)
+}
+
+func (a *zipArchiver) AddContent(pathInArchive string, content []byte, modTime time.Time) error {
+	header := &zip.FileHeader{
+		Name:               pathInArchive,
+		Method:             zip.Deflate,
+		Modified:           modTime,
+		UncompressedSize64: uint64(len(content)),
+	}
+	header.SetMode(0o644)
+
+	if a.jobs != nil {
+		return a.queueJob(&zipJob{path: pathInArchive, content: string(content), header: header})
+	}
+
+	return a.writeEntry(header, bytes.NewReader(content))
+}
+
+func (a *zipArchiver) SetComment(comment string) {
+	a.comment = comment
+}
+
+// flush writes all queued entries to the archive, so the content hashes of the entries are complete.
+// Later entries are written without the workers.
+func (a *zipArchiver) flush() error {
+	if a.jobs == nil {
+		return nil
+	}
+
+	err := a.stopWorkers()
+	a.jobs = nil
+
+	return err
+}
+
+func (a *zipArchiver) Close() error {
+	if a.jobs != nil {
+		if err := a.stopWorkers(); err != nil {
+			return err
+		}
+	}
+
+	if err := a.zw.SetComment(a.comment); err != nil {
+		return err
+	}
+
+	return a.zw.Close()
+}
+
+// addFileToZip writes a single file to the archive. The content of regular files is added to the given hash,
+// which may be nil.
+func (a *zipArchiver) addFileToZip(path string, pathInArchive string, contentHash *contentHash) error {
+	header, dataPath, content, err := a.fileHeader(path, pathInArchive)
+	if err != nil {
+		return err
+	}
+
+	var data io.Reader = strings.NewReader(content)
+	if dataPath != "" {
+		file, err := os.Open(dataPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		header.Method, err = a.selectMethod(file, pathInArchive)
+		if err != nil {
+			return err
+		}
+
+		data = contentHash.tee(file)
+	}
+
+	if err := a.writeEntry(header, data); err != nil {
+		return err
+	}
+
+	if dataPath != "" {
+		contentHash.finish()
+	}
+
+	return nil
+}
+
+// writeEntry compresses the data of an entry and writes it to the archive
+func (a *zipArchiver) writeEntry(header *zip.FileHeader, data io.Reader) error {
+	if a.password != "" {
+		encryptHeader(header)
+	}
+
+	prepareRawHeader(header)
+
+	// write the header to the zip archiver
+	writer, err := a.zw.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+
+	// compress the file data into the zip
+	if err := a.compressEntry(writer, data, header); err != nil {
+		return err
+	}
+
+	logEntryCompression(header)
+
+	return nil
+}
+
+// fileHeader creates the header of a zip entry for the given file. It returns the path the content
+// is read from, which differs for followed symlinks, or the content itself for all other types of files.
+// Symlinks are stored like Info-ZIP does: with the symlink file mode and the link target as content.
+func (a *zipArchiver) fileHeader(path string, pathInArchive string) (*zip.FileHeader, string, string, error) {
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	var linkTarget string
+
+	if stat.Mode()&os.ModeSymlink != 0 {
+		if a.unit.FollowSymlinks {
+			linkTargetPath, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return nil, "", "", err
+			}
+
+			if stat, err = os.Stat(linkTargetPath); err != nil {
+				log.Printf("Can't access link target!")
+				return nil, "", "", err
+			}
+
+			path = linkTargetPath
+		} else if linkTarget, err = os.Readlink(path); err != nil {
+			return nil, "", "", fmt.Errorf("%s: readlink: %v", stat.Name(), err)
+		}
+	}
+
+	// FIFOs and device files are stored without content, only their file mode is kept
+	isInline := linkTarget != "" || stat.IsDir() || stat.Mode()&(os.ModeNamedPipe|os.ModeDevice) != 0
+	if !isInline && !stat.Mode().IsRegular() {
+		return nil, "", "", fmt.Errorf("%s: file is not regular", path)
+	}
+
+	header, err := zip.FileInfoHeader(stat)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	header.Name = pathInArchive
+	if stat.IsDir() && !strings.HasSuffix(header.Name, "/") {
+		header.Name += "/"
+	}
+
+	if a.unit.Reproducible {
+		header.Modified = reproducibleModTime(header.Modified)
+	} else if uid, gid, ok := ownerOf(stat); ok {
+		header.Extra = append(header.Extra, unixOwnerExtra(uid, gid)...)
+	}
+
+	if isInline {
+		header.Method = zip.Store
+		header.UncompressedSize64 = uint64(len(linkTarget))
+
+		return header, "", linkTarget, nil
+	}
+
+	return header, path, "", nil
+}
+
+// unixOwnerExtra returns the Info-ZIP unix extra field with the uid and gid of a file
+func unixOwnerExtra(uid uint32, gid uint32) []byte {
+	extra := make([]byte, 15)
+	binary.LittleEndian.PutUint16(extra[0:], unixExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 11)
+	extra[4] = 1 // version
+	extra[5] = 4 // size of the uid
+	binary.LittleEndian.PutUint32(extra[6:], uid)
+	extra[10] = 4 // size of the gid
+	binary.LittleEndian.PutUint32(extra[11:], gid)
+
+	return extra
+}
+
+// newEntryCompressor returns a writer which compresses the data of an entry with the given method
+func (a *zipArchiver) newEntryCompressor(w io.Writer, method uint16) (io.WriteCloser, error) {
+	switch method {
+	case zip.Store:
+		return nopWriteCloser{w}, nil
+	case zip.Deflate:
+		return flate.NewWriter(w, a.unit.CompressionLevel)
+	case zstd.ZipMethodWinZip:
+		level := zstd.SpeedDefault
+		if a.unit.CompressionLevel > 0 {
+			level = zstd.EncoderLevelFromZstd(a.unit.CompressionLevel)
+		}
+
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, zip.ErrAlgorithm
+	}
+}
+
+// compressEntry compresses the data of an entry into w and stores checksum and sizes in the header.
+// Entries marked by encryptHeader are encrypted after compression.
+func (a *zipArchiver) compressEntry(w io.Writer, data io.Reader, header *zip.FileHeader) error {
+	compressedCounter := &countingWriter{w: w}
+
+	method := header.Method
+	var out io.Writer = compressedCounter
+	var encryptor *aesWriter
+
+	if header.Method == winZipAESMethod {
+		_, method, _ = aesExtra(header.Extra)
+
+		var err error
+		if encryptor, err = newAESWriter(compressedCounter, a.password); err != nil {
+			return err
+		}
+
+		out = encryptor
+	}
+
+	cw, err := a.newEntryCompressor(out, method)
+	if err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	uncompressedSize, err := io.Copy(io.MultiWriter(cw, crc), data)
+	if err != nil {
+		return err
+	}
+
+	if err := cw.Close(); err != nil {
+		return err
+	}
+
+	header.CRC32 = crc.Sum32()
+
+	if encryptor != nil {
+		if err := encryptor.Close(); err != nil {
+			return err
+		}
+
+		// AE-2 leaves out the checksum, as it would leak information about the content
+		header.CRC32 = 0
+	}
+	header.UncompressedSize64 = uint64(uncompressedSize)
+	header.CompressedSize64 = uint64(compressedCounter.n)
+	header.UncompressedSize = uint32(min64(header.UncompressedSize64, math.MaxUint32))
+	header.CompressedSize = uint32(min64(header.CompressedSize64, math.MaxUint32))
+
+	return nil
+}
+
+func min64(x, y uint64) uint64 {
+	if x < y {
+		return x
+	}
+
+	return y
+}
+
+// timeToMsDosTime converts a time into the MS-DOS date and time format used in zip headers
+func timeToMsDosTime(t time.Time) (uint16, uint16) {
+	fDate := uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	fTime := uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+
+	return fDate, fTime
+}
+
+// isASCII checks if a string only consists of ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
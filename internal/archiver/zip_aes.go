@@ -0,0 +1,311 @@
+package archiver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/d-Rickyy-b/backmeup/internal/bkperrors"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/term"
+)
+
+// The WinZip AES format, as implemented by 7-Zip and WinZip, is described at https://www.winzip.com/en/support/aes-encryption/
+const (
+	winZipAESMethod     = 99     // compression method of encrypted entries, the actual method is stored in the extra field
+	winZipAESExtraID    = 0x9901 // extra field with the AES parameters
+	winZipAESVersion    = 2      // AE-2 does not store the CRC, the data is authenticated by the MAC instead
+	winZipAESStrength   = 3      // AES-256
+	winZipAESSaltSize   = 16
+	winZipAESKeySize    = 32
+	winZipAESIterations = 1000
+	winZipAESMACSize    = 10
+	zipVersion51        = 51 // zip version 5.1, which is required for AES encryption
+)
+
+// zipPassword reads the password for encrypting the zip archive of a unit. Without passphrase_file
+// and passphrase_env, the password is read from the terminal.
+func zipPassword(unitName string, passphraseFile string, passphraseEnv string) (string, error) {
+	if passphraseFile != "" || passphraseEnv != "" {
+		return readPassphrase(passphraseFile, passphraseEnv)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("no passphrase_file or passphrase_env is set and stdin is not a terminal to enter the password")
+	}
+
+	var passwords [2]string
+
+	for i, prompt := range []string{"Enter the password for unit '%s': ", "Repeat the password for unit '%s': "} {
+		fmt.Fprintf(os.Stderr, prompt, unitName)
+
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+
+		if err != nil {
+			return "", fmt.Errorf("reading password: %w", err)
+		}
+
+		passwords[i] = string(password)
+	}
+
+	if passwords[0] != passwords[1] {
+		return "", errors.New("the passwords do not match")
+	}
+
+	if passwords[0] == "" {
+		return "", errors.New("the password is empty")
+	}
+
+	return passwords[0], nil
+}
+
+// encryptHeader marks the entry as encrypted and moves the compression method into the AES extra field.
+// Only regular files are encrypted. Directories, symlinks and special files stay unencrypted, as tools
+// like bsdtar can't extract them otherwise.
+func encryptHeader(header *zip.FileHeader) {
+	if !header.Mode().IsRegular() {
+		return
+	}
+
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], winZipAESExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], winZipAESVersion)
+	copy(extra[6:], "AE")
+	extra[8] = winZipAESStrength
+	binary.LittleEndian.PutUint16(extra[9:], header.Method)
+
+	header.Extra = append(header.Extra, extra...)
+	header.Method = winZipAESMethod
+	header.Flags |= 0x1
+}
+
+// aesExtra returns the strength and the actual compression method stored in the AES extra field
+func aesExtra(extra []byte) (byte, uint16, bool) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+
+		if len(extra) < 4+size {
+			break
+		}
+
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+
+		if id == winZipAESExtraID && size == 7 && string(field[2:4]) == "AE" {
+			return field[4], binary.LittleEndian.Uint16(field[5:]), true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// aesKeys derives the encryption key, the authentication key and the password verifier from the password
+func aesKeys(password string, salt []byte, keySize int) ([]byte, []byte, []byte) {
+	keys := pbkdf2.Key([]byte(password), salt, winZipAESIterations, 2*keySize+2, sha1.New)
+
+	return keys[:keySize], keys[keySize : 2*keySize], keys[2*keySize:]
+}
+
+// aesWriter encrypts the data of a zip entry. The salt and the password verifier are written
+// in front of the data, the MAC is written when the writer is closed.
+type aesWriter struct {
+	w      io.Writer
+	stream cipher.Stream
+	mac    hash.Hash
+	buffer []byte
+}
+
+func newAESWriter(w io.Writer, password string) (*aesWriter, error) {
+	salt := make([]byte, winZipAESSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	encryptionKey, macKey, verifier := aesKeys(password, salt, winZipAESKeySize)
+
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(append(salt, verifier...)); err != nil {
+		return nil, err
+	}
+
+	return &aesWriter{w: w, stream: newWinZipCTR(block), mac: hmac.New(sha1.New, macKey)}, nil
+}
+
+func (a *aesWriter) Write(p []byte) (int, error) {
+	if cap(a.buffer) < len(p) {
+		a.buffer = make([]byte, len(p))
+	}
+
+	ciphertext := a.buffer[:len(p)]
+	a.stream.XORKeyStream(ciphertext, p)
+	a.mac.Write(ciphertext)
+
+	return a.w.Write(ciphertext)
+}
+
+func (a *aesWriter) Close() error {
+	_, err := a.w.Write(a.mac.Sum(nil)[:winZipAESMACSize])
+
+	return err
+}
+
+// openAESEntry returns a reader for the decrypted and decompressed content of an encrypted entry.
+// The content is authenticated when the reader reaches its end.
+func openAESEntry(file *zip.File, password string) (io.ReadCloser, error) {
+	strength, method, ok := aesExtra(file.Extra)
+	if !ok || strength < 1 || strength > 3 {
+		return nil, fmt.Errorf("unsupported encryption of entry '%s'", file.Name)
+	}
+
+	if password == "" {
+		return nil, fmt.Errorf("the entry '%s' is encrypted, but no password was given", file.Name)
+	}
+
+	keySize := 8 + 8*int(strength)
+	saltSize := keySize / 2
+
+	if file.CompressedSize64 < uint64(saltSize+2+winZipAESMACSize) {
+		return nil, fmt.Errorf("encrypted entry '%s' is truncated", file.Name)
+	}
+
+	raw, err := file.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, saltSize+2)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+
+	encryptionKey, macKey, verifier := aesKeys(password, header[:saltSize], keySize)
+	if subtle.ConstantTimeCompare(verifier, header[saltSize:]) != 1 {
+		return nil, fmt.Errorf("%w for encrypted entry '%s'", bkperrors.ErrWrongPassword, file.Name)
+	}
+
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertextSize := int64(file.CompressedSize64) - int64(len(header)) - winZipAESMACSize
+
+	decrypted := &aesReader{
+		name:       file.Name,
+		raw:        raw,
+		ciphertext: io.LimitReader(raw, ciphertextSize),
+		stream:     newWinZipCTR(block),
+		mac:        hmac.New(sha1.New, macKey),
+	}
+
+	var decompressed io.ReadCloser
+
+	switch method {
+	case zip.Store:
+		decompressed = io.NopCloser(decrypted)
+	case zip.Deflate:
+		decompressed = flate.NewReader(decrypted)
+	case zstd.ZipMethodWinZip:
+		decompressed = zstd.ZipDecompressor()(decrypted)
+	default:
+		return nil, zip.ErrAlgorithm
+	}
+
+	return &authenticatedReader{ReadCloser: decompressed, decrypted: decrypted}, nil
+}
+
+// authenticatedReader makes sure the MAC of an entry is verified. Decompressors stop reading at the end
+// of the compressed data, so the rest of the decrypted data is read once they are done.
+type authenticatedReader struct {
+	io.ReadCloser
+	decrypted io.Reader
+}
+
+func (a *authenticatedReader) Read(p []byte) (int, error) {
+	n, err := a.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		if _, err := io.Copy(io.Discard, a.decrypted); err != nil {
+			return n, err
+		}
+	}
+
+	return n, err
+}
+
+// aesReader decrypts the data of an entry and verifies its MAC at the end of the data
+type aesReader struct {
+	name       string
+	raw        io.Reader
+	ciphertext io.Reader
+	stream     cipher.Stream
+	mac        hash.Hash
+}
+
+func (a *aesReader) Read(p []byte) (int, error) {
+	n, err := a.ciphertext.Read(p)
+	a.mac.Write(p[:n])
+	a.stream.XORKeyStream(p[:n], p[:n])
+
+	if !errors.Is(err, io.EOF) {
+		return n, err
+	}
+
+	expected := make([]byte, winZipAESMACSize)
+	if _, err := io.ReadFull(a.raw, expected); err != nil {
+		return n, err
+	}
+
+	if !hmac.Equal(expected, a.mac.Sum(nil)[:winZipAESMACSize]) {
+		return n, fmt.Errorf("the content of the encrypted entry '%s' is corrupted", a.name)
+	}
+
+	return n, io.EOF
+}
+
+// winZipCTR is the counter mode used by WinZip. Unlike cipher.NewCTR, the counter is little endian and starts at 1.
+type winZipCTR struct {
+	block     cipher.Block
+	counter   uint64
+	keyStream []byte
+	used      int
+}
+
+func newWinZipCTR(block cipher.Block) *winZipCTR {
+	return &winZipCTR{block: block, keyStream: make([]byte, aes.BlockSize), used: aes.BlockSize}
+}
+
+func (c *winZipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			c.counter++
+
+			var counterBlock [aes.BlockSize]byte
+			binary.LittleEndian.PutUint64(counterBlock[:], c.counter)
+			c.block.Encrypt(c.keyStream, counterBlock[:])
+			c.used = 0
+		}
+
+		dst[i] = src[i] ^ c.keyStream[c.used]
+		c.used++
+	}
+}
@@ -0,0 +1,114 @@
+package archiver
+
+import (
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// entropyProbeSize is the amount of bytes read from the start of a file to estimate its compressibility
+	entropyProbeSize = 64 << 10
+	// entropyThreshold is the entropy in bits per byte above which data is considered incompressible
+	entropyThreshold = 7.5
+)
+
+// zipMethods maps the values of the zip_method option to the zip compression methods
+var zipMethods = map[string]uint16{
+	"store":   zip.Store,
+	"deflate": zip.Deflate,
+	"zstd":    zstd.ZipMethodWinZip,
+}
+
+// zipMethodName returns the name of a zip compression method for logging
+func zipMethodName(method uint16) string {
+	for name, m := range zipMethods {
+		if m == method {
+			return name
+		}
+	}
+
+	return "unknown"
+}
+
+// selectMethod picks the compression method for a single zip entry. Files with one of the configured
+// store_extensions and files which look incompressible are stored, all others use the configured zip_method.
+func (a *zipArchiver) selectMethod(file *os.File, pathInArchive string) (uint16, error) {
+	method := zipMethods[a.unit.ZipMethod]
+	if method == zip.Store {
+		return method, nil
+	}
+
+	lowerPath := strings.ToLower(pathInArchive)
+	for _, extension := range a.unit.StoreExtensions {
+		if strings.HasSuffix(lowerPath, "."+strings.ToLower(strings.TrimPrefix(extension, "."))) {
+			if DEBUG {
+				log.Printf("Storing '%s' without compression because of its extension", pathInArchive)
+			}
+
+			return zip.Store, nil
+		}
+	}
+
+	probe := make([]byte, entropyProbeSize)
+	n, err := file.ReadAt(probe, 0)
+	if err != nil && err != io.EOF {
+		return method, err
+	}
+
+	if entropy := shannonEntropy(probe[:n]); entropy > entropyThreshold {
+		if DEBUG {
+			log.Printf("Storing '%s' without compression because of its high entropy (%.2f bits/byte)", pathInArchive, entropy)
+		}
+
+		return zip.Store, nil
+	}
+
+	return method, nil
+}
+
+// shannonEntropy calculates the entropy of the given data in bits per byte
+func shannonEntropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+
+		p := float64(count) / float64(len(data))
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
+
+// logEntryCompression logs the compression method and the saved size of a written entry.
+// Encrypted entries are logged with the compression method stored in their AES extra field.
+func logEntryCompression(header *zip.FileHeader) {
+	if !DEBUG {
+		return
+	}
+
+	method := header.Method
+	if _, aesMethod, ok := aesExtra(header.Extra); ok && method == winZipAESMethod {
+		method = aesMethod
+	}
+
+	saved := int64(header.UncompressedSize64) - int64(header.CompressedSize64)
+	log.Printf("Added '%s' with method %s: %d -> %d bytes (saved %d bytes)",
+		header.Name, zipMethodName(method), header.UncompressedSize64, header.CompressedSize64, saved)
+}
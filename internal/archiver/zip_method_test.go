@@ -0,0 +1,146 @@
+package archiver
+
+import (
+	"bytes"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+	"github.com/klauspost/compress/zip"
+)
+
+func TestShannonEntropy(t *testing.T) {
+	uniform := make([]byte, 256)
+	for i := range uniform {
+		uniform[i] = byte(i)
+	}
+
+	entropies := map[string]float64{
+		"":                   0,
+		"aaaaaaaa":           0,
+		"abababab":           1,
+		"abcdabcd":           2,
+		string(uniform):      8,
+		string(uniform[:16]): 4,
+	}
+
+	for data, expected := range entropies {
+		if entropy := shannonEntropy([]byte(data)); math.Abs(entropy-expected) > 1e-9 {
+			t.Fatalf("Entropy of %q is %f instead of %f", data, entropy, expected)
+		}
+	}
+}
+
+func TestSelectMethod(t *testing.T) {
+	sourcePath := t.TempDir()
+
+	random := make([]byte, entropyProbeSize)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	text := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 1000))
+
+	// Files with a store extension and high-entropy files are stored, text is compressed
+	contents := map[string][]byte{
+		"photo.JPG":  text,
+		"image.png":  text,
+		"random.bin": random,
+		"notes.txt":  text,
+	}
+	expected := map[string]uint16{
+		"photo.JPG":  zip.Store,
+		"image.png":  zip.Store,
+		"random.bin": zip.Store,
+		"notes.txt":  zip.Deflate,
+	}
+
+	unit := config.Unit{
+		Name:             "test",
+		ArchiveType:      "zip",
+		CompressionLevel: config.DefaultCompressionLevel,
+		Workers:          1,
+		ZipMethod:        "deflate",
+		StoreExtensions:  []string{"jpg", ".png"},
+	}
+	a := &zipArchiver{unit: unit}
+
+	var files []BackupFileMetadata
+	methods := make(map[string]uint16)
+
+	for name, content := range contents {
+		path := filepath.Join(sourcePath, name)
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		selected, err := a.selectMethod(file, name)
+		file.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if selected != expected[name] {
+			t.Fatalf("Method %s was selected for '%s' instead of %s", zipMethodName(selected), name, zipMethodName(expected[name]))
+		}
+
+		files = append(files, BackupFileMetadata{Path: path, BackupBasePath: sourcePath})
+		methods[getPathInArchive(path, sourcePath, unit)] = expected[name]
+	}
+
+	// The selected methods end up in the archive
+	archivePath := filepath.Join(t.TempDir(), "test.zip")
+	if err := WriteArchive(archivePath, files, unit); err != nil {
+		t.Fatal(err)
+	}
+
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zipReader.Close()
+
+	checked := 0
+	for _, file := range zipReader.File {
+		if method, exists := methods[file.Name]; exists {
+			if file.Method != method {
+				t.Fatalf("Entry '%s' was written with method %s instead of %s", file.Name, zipMethodName(file.Method), zipMethodName(method))
+			}
+
+			checked++
+		}
+	}
+
+	if checked != len(methods) {
+		t.Fatalf("Found %d of %d entries in '%s'", checked, len(methods), archivePath)
+	}
+}
+
+func TestLogEntryCompressionEncrypted(t *testing.T) {
+	var output bytes.Buffer
+
+	log.SetOutput(&output)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	DEBUG = true
+	t.Cleanup(func() { DEBUG = false })
+
+	header := &zip.FileHeader{Name: "notes.txt", Method: zipMethods["zstd"]}
+	header.SetMode(0o644)
+	encryptHeader(header)
+
+	logEntryCompression(header)
+
+	if !strings.Contains(output.String(), "with method zstd") {
+		t.Fatalf("Encrypted entry was logged as '%s'", strings.TrimSpace(output.String()))
+	}
+}
@@ -0,0 +1,306 @@
+package archiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zipJob is a single file which is compressed by one of the workers and then written to the archive
+type zipJob struct {
+	path string
+	// dataPath is the file the content is read from. Entries without dataPath have their content inline.
+	dataPath string
+	content  string
+	// bound is the maximum size of the compressed data, which is reserved in the memory budget
+	bound  int64
+	header *zip.FileHeader
+	// contentHash hashes the content of the file while it is compressed
+	contentHash *contentHash
+	// reserved is the part of the memory budget held by this job. Jobs which do not fit
+	// into the memory budget are compressed into a temporary spill file instead.
+	reserved  int64
+	buffer    bytes.Buffer
+	spillFile *os.File
+	err       error
+	done      chan struct{}
+}
+
+// data returns a reader for the compressed data of the job
+func (job *zipJob) data() (io.Reader, error) {
+	if job.spillFile == nil {
+		return &job.buffer, nil
+	}
+
+	if _, err := job.spillFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return job.spillFile, nil
+}
+
+// cleanup frees the resources used by the job
+func (job *zipJob) cleanup() {
+	job.buffer = bytes.Buffer{}
+
+	if job.spillFile != nil {
+		job.spillFile.Close()
+		os.Remove(job.spillFile.Name())
+	}
+}
+
+// memoryBudget limits the amount of memory used by the buffers of all in-flight jobs
+type memoryBudget struct {
+	limit     int64
+	available int64
+	mu        sync.Mutex
+	cond      *sync.Cond
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	budget := &memoryBudget{limit: limit, available: limit}
+	budget.cond = sync.NewCond(&budget.mu)
+
+	return budget
+}
+
+// acquire blocks until the given amount of bytes is available
+func (b *memoryBudget) acquire(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.available < n {
+		b.cond.Wait()
+	}
+
+	b.available -= n
+}
+
+// release returns the given amount of bytes to the budget
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.available += n
+	b.mu.Unlock()
+
+	b.cond.Broadcast()
+}
+
+// startWorkers starts the compression workers and the goroutine which writes the compressed entries in order
+func (a *zipArchiver) startWorkers() {
+	workers := workerCount(a.unit)
+	a.budget = newMemoryBudget(a.unit.MemoryBudget)
+	a.jobs = make(chan *zipJob)
+	a.pending = make(chan *zipJob, 4*workers)
+	a.writerDone = make(chan struct{})
+
+	for i := 0; i < workers; i++ {
+		a.workers.Add(1)
+
+		go func() {
+			defer a.workers.Done()
+
+			for job := range a.jobs {
+				job.err = a.compressJob(job)
+				close(job.done)
+			}
+		}()
+	}
+
+	go a.writeJobs()
+}
+
+// queueFile hands a file to the compression workers. Budget is acquired in the order of the entries,
+// so the entry which is written next never waits for budget held by later entries.
+func (a *zipArchiver) queueFile(path string, pathInArchive string, contentHash *contentHash) error {
+	header, dataPath, content, err := a.fileHeader(path, pathInArchive)
+	if err != nil {
+		return err
+	}
+
+	return a.queueJob(&zipJob{path: path, dataPath: dataPath, content: content, header: header, contentHash: contentHash})
+}
+
+// queueJob reserves the memory budget for a job and hands it to the workers
+func (a *zipArchiver) queueJob(job *zipJob) error {
+	// The method of files is selected by the workers, it is either store or the configured method
+	method := job.header.Method
+	if job.dataPath != "" {
+		method = zipMethods[a.unit.ZipMethod]
+	}
+
+	job.bound = a.compressBound(int64(job.header.UncompressedSize64), method)
+	job.done = make(chan struct{})
+
+	if job.bound <= a.budget.limit {
+		job.reserved = job.bound
+	}
+
+	a.budget.acquire(job.reserved)
+	a.pending <- job
+	a.jobs <- job
+
+	return nil
+}
+
+// compressBound returns the maximum size of size bytes compressed with the given method, including the
+// overhead of encryption. Stored data never exceeds the bound of the other methods.
+func (a *zipArchiver) compressBound(size int64, method uint16) int64 {
+	bound := size
+
+	switch method {
+	case zip.Deflate:
+		// Incompressible data is written as stored blocks with a header of 5 bytes each. The blocks are at least
+		// 16 KiB large, the final block adds 2 more bytes.
+		bound += 5*(size/(16<<10)+1) + 2
+	case zstd.ZipMethodWinZip:
+		// Same as ZSTD_COMPRESSBOUND of the reference implementation
+		bound += size >> 8
+		if size < 128<<10 {
+			bound += (128<<10 - size) >> 11
+		}
+	}
+
+	if a.password != "" {
+		bound += winZipAESSaltSize + 2 + winZipAESMACSize
+	}
+
+	return bound
+}
+
+// compressJob compresses the file of the job into memory or into a spill file
+func (a *zipArchiver) compressJob(job *zipJob) error {
+	if job.dataPath == "" {
+		if a.password != "" {
+			encryptHeader(job.header)
+		}
+
+		job.buffer.Grow(int(job.reserved))
+
+		return a.compressEntry(&job.buffer, strings.NewReader(job.content), job.header)
+	}
+
+	file, err := os.Open(job.dataPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	job.header.Method, err = a.selectMethod(file, job.header.Name)
+	if err != nil {
+		return err
+	}
+
+	if a.password != "" {
+		encryptHeader(job.header)
+	}
+
+	// The buffer is allocated at its bound at once, so growing it never exceeds the reserved budget
+	var out io.Writer = &job.buffer
+	if job.reserved < job.bound {
+		job.spillFile, err = os.CreateTemp("", "backmeup-zip-*")
+		if err != nil {
+			return err
+		}
+
+		out = job.spillFile
+	} else {
+		job.buffer.Grow(int(job.reserved))
+	}
+
+	return a.compressEntry(out, job.contentHash.tee(file), job.header)
+}
+
+// writeJobs writes the compressed entries to the archive in the order they were queued
+func (a *zipArchiver) writeJobs() {
+	defer close(a.writerDone)
+
+	for job := range a.pending {
+		<-job.done
+
+		if job.err == nil && a.writeErr == nil {
+			job.err = a.writeRaw(job)
+			a.writeErr = job.err
+		}
+
+		if job.err != nil {
+			log.Printf("Error while adding %s to the archive. %s", job.path, job.err)
+		} else if job.dataPath != "" {
+			job.contentHash.finish()
+		}
+
+		job.cleanup()
+		a.budget.release(job.reserved)
+	}
+}
+
+// writeRaw writes the already compressed data of the job to the archive
+func (a *zipArchiver) writeRaw(job *zipJob) error {
+	data, err := job.data()
+	if err != nil {
+		return err
+	}
+
+	prepareRawHeader(job.header)
+
+	writer, err := a.zw.CreateRaw(job.header)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(writer, data); err != nil {
+		return err
+	}
+
+	logEntryCompression(job.header)
+
+	return nil
+}
+
+// stopWorkers waits until all queued entries are written to the archive
+func (a *zipArchiver) stopWorkers() error {
+	close(a.jobs)
+	close(a.pending)
+	a.workers.Wait()
+	<-a.writerDone
+
+	return a.writeErr
+}
+
+// prepareRawHeader sets the header fields, which zip.Writer.CreateHeader sets for regular entries,
+// but zip.Writer.CreateRaw does not.
+func prepareRawHeader(header *zip.FileHeader) {
+	// The checksum and sizes of sequentially written entries are only known after compressing, so they are
+	// written into a data descriptor. Compressed entries of the workers use the same layout.
+	header.Flags |= 0x8
+
+	if !isASCII(header.Name) && utf8.ValidString(header.Name) {
+		header.Flags |= 0x800
+	}
+
+	header.CreatorVersion = header.CreatorVersion&0xff00 | zipVersion20
+	header.ReaderVersion = zipVersion20
+
+	if header.Method == winZipAESMethod {
+		header.ReaderVersion = zipVersion51
+	}
+
+	if !header.Modified.IsZero() {
+		header.ModifiedDate, header.ModifiedTime = timeToMsDosTime(header.Modified)
+
+		// Extended timestamp extra field with the modification time, like CreateHeader writes it
+		extra := make([]byte, 9)
+		binary.LittleEndian.PutUint16(extra[0:], extTimeExtraID)
+		binary.LittleEndian.PutUint16(extra[2:], 5)
+		extra[4] = 1
+		binary.LittleEndian.PutUint32(extra[5:], uint32(header.Modified.Unix()))
+		header.Extra = append(header.Extra, extra...)
+	}
+}
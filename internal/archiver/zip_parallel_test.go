@@ -0,0 +1,177 @@
+package archiver
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/d-Rickyy-b/backmeup/internal/config"
+	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestWriteArchiveParallelZip(t *testing.T) {
+	sourcePath := t.TempDir()
+	contents := map[string]string{
+		"a.txt": "hello world",
+		"b.log": strings.Repeat("log line\n", 10000),
+		"c.csv": "1,2,3\n4,5,6\n",
+		"d.txt": strings.Repeat("the quick brown fox\n", 5000),
+	}
+
+	var files []BackupFileMetadata
+	for _, name := range []string{"a.txt", "b.log", "c.csv", "d.txt"} {
+		path := filepath.Join(sourcePath, name)
+		if err := os.WriteFile(path, []byte(contents[name]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		files = append(files, BackupFileMetadata{Path: path, BackupBasePath: sourcePath})
+	}
+
+	// A tiny budget forces larger entries into spill files
+	for _, memoryBudget := range []int64{64, 1 << 20} {
+		for _, zipMethod := range []string{"deflate", "zstd"} {
+			unit := config.Unit{
+				Name:             "test",
+				ArchiveType:      "zip",
+				CompressionLevel: config.DefaultCompressionLevel,
+				Workers:          4,
+				MemoryBudget:     memoryBudget,
+				ZipMethod:        zipMethod,
+			}
+
+			archivePath := filepath.Join(t.TempDir(), "test.zip")
+			if err := WriteArchive(archivePath, files, unit); err != nil {
+				t.Fatal(err)
+			}
+
+			checkParallelZip(t, archivePath, files, contents, unit)
+		}
+	}
+}
+
+func TestWriteArchiveZipWorkers(t *testing.T) {
+	files := createTestFiles(t)
+
+	for _, password := range []string{"", "secret"} {
+		t.Setenv("BACKMEUP_TEST_PASSPHRASE", password)
+
+		var archives [][]byte
+
+		for _, workers := range []int{1, 4} {
+			unit := testUnit("zip")
+			unit.Reproducible = true
+			unit.Workers = workers
+
+			if password != "" {
+				unit.Encryption = "aes256"
+				unit.PassphraseEnv = "BACKMEUP_TEST_PASSPHRASE"
+			}
+
+			archivePath := filepath.Join(t.TempDir(), "test.zip")
+			if err := WriteArchive(archivePath, files, unit); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(archivePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			archives = append(archives, data)
+		}
+
+		// Encrypted entries use a random salt, so only their layout is compared
+		if password == "" && !bytes.Equal(archives[0], archives[1]) {
+			t.Fatalf("Zip archives written with 1 and 4 workers differ")
+		} else if len(archives[0]) != len(archives[1]) {
+			t.Fatalf("Zip archives written with 1 and 4 workers have %d and %d bytes", len(archives[0]), len(archives[1]))
+		}
+	}
+}
+
+func TestCompressBound(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for _, zipMethod := range []string{"store", "deflate", "zstd"} {
+		for _, level := range []int{config.DefaultCompressionLevel, 1, 9} {
+			for _, password := range []string{"", "secret"} {
+				unit := config.Unit{Name: "test", ArchiveType: "zip", CompressionLevel: level, ZipMethod: zipMethod}
+				a := &zipArchiver{unit: unit, password: password}
+
+				// Random data can't be compressed, so its compressed size is close to the bound
+				for _, size := range []int{0, 1, 1000, 65535, 65536, 200000, 1<<20 + 7} {
+					data := make([]byte, size)
+					random.Read(data)
+
+					header := &zip.FileHeader{Method: zipMethods[zipMethod]}
+					if password != "" {
+						header.SetMode(0o644)
+						encryptHeader(header)
+					}
+
+					var compressed bytes.Buffer
+					if err := a.compressEntry(&compressed, bytes.NewReader(data), header); err != nil {
+						t.Fatal(err)
+					}
+
+					if bound := a.compressBound(int64(size), zipMethods[zipMethod]); int64(compressed.Len()) > bound {
+						t.Fatalf("%d bytes compressed with %s at level %d to %d bytes, more than the bound of %d bytes", size, zipMethod, level, compressed.Len(), bound)
+					}
+				}
+			}
+		}
+	}
+}
+
+// checkParallelZip checks that the archive contains the files in the given order with the given contents
+func checkParallelZip(t *testing.T, archivePath string, files []BackupFileMetadata, contents map[string]string, unit config.Unit) {
+	t.Helper()
+
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zipReader.Close()
+
+	zipReader.RegisterDecompressor(zstd.ZipMethodWinZip, zstd.ZipDecompressor())
+
+	entries := make(map[string]*zip.File)
+	var names []string
+
+	for _, file := range zipReader.File {
+		entries[file.Name] = file
+		names = append(names, file.Name)
+	}
+
+	// Entries are written in the order they were added, although they are compressed in parallel
+	position := 0
+	for _, file := range files {
+		name := getPathInArchive(file.Path, file.BackupBasePath, unit)
+
+		for position < len(names) && names[position] != name {
+			position++
+		}
+
+		if position == len(names) {
+			t.Fatalf("Entry '%s' is missing or out of order in '%s': %v", name, archivePath, names)
+		}
+
+		reader, err := entries[name].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := io.ReadAll(reader)
+		reader.Close()
+
+		if err != nil || string(content) != contents[filepath.Base(file.Path)] {
+			t.Fatalf("Content of entry '%s' in '%s' does not match: %v", name, archivePath, err)
+		}
+	}
+}
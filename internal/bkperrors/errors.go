@@ -5,4 +5,9 @@ import "errors"
 var (
 	ErrCannotAccessSrcDir = errors.New("can't access source directory")
 	ErrCannotAccessDstDir = errors.New("can't access destination directory")
+	ErrUnknownArchiveType = errors.New("unknown archive type")
+	ErrInvalidOption      = errors.New("invalid option value")
+	ErrSpecialFile        = errors.New("special file found")
+	ErrUnrepairable       = errors.New("archive can't be repaired")
+	ErrWrongPassword      = errors.New("wrong password")
 )
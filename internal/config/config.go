@@ -1,41 +1,179 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
+	"filippo.io/age"
 	"github.com/d-Rickyy-b/backmeup/internal/bkperrors"
 	"gopkg.in/yaml.v2"
 )
 
 type Unit struct {
-	Name             string
-	Sources          []string
-	Destination      string
-	Excludes         []string
-	ArchiveType      string
-	AddSubfolder     bool
-	Enabled          bool
-	UseAbsolutePaths bool
-	FollowSymlinks   bool
+	Name               string
+	Sources            []string
+	Destination        string
+	Excludes           []string
+	ArchiveType        string
+	AddSubfolder       bool
+	Enabled            bool
+	UseAbsolutePaths   bool
+	FollowSymlinks     bool
+	CompressionLevel   int
+	Workers            int
+	MemoryBudget       int64
+	ZipMethod          string
+	StoreExtensions    []string
+	VolumeSize         int64
+	PreserveXattrs     bool
+	Directories        string
+	SpecialFiles       string
+	Reproducible       bool
+	TarFormat          string
+	TimestampPrecision string
+	EntryOrder         string
+	ManifestFile       bool
+	PathMode           string
+	Seekable           bool
+	RecoveryPercent    int
+	Encryption         string
+	Recipients         []string
+	PassphraseFile     string
+	PassphraseEnv      string
+	// ArchivePrefixes maps source paths to the directory their content is stored in within the archive
+	ArchivePrefixes map[string]string
 }
 
 type Config struct {
 	Units []Unit
 }
 
+// archiveTypes contains all archive types which can be used for the archive_type option
+var archiveTypes = make(map[string]bool)
+
+// RegisterArchiveType marks the given archive type as valid value for the archive_type option
+func RegisterArchiveType(archiveType string) {
+	archiveTypes[archiveType] = true
+}
+
+// levelRange is the range of compression levels supported by an archive type
+type levelRange struct {
+	min int
+	max int
+}
+
+// compressionLevels contains the valid compression levels of the archive types, which compress their content
+var compressionLevels = make(map[string]levelRange)
+
+// RegisterCompressionLevels sets the range of valid values of the compression_level option for the given archive type.
+// Archive types without registered range ignore the compression level.
+func RegisterCompressionLevels(archiveType string, minLevel int, maxLevel int) {
+	compressionLevels[archiveType] = levelRange{min: minLevel, max: maxLevel}
+}
+
+// ValidCompressionLevel checks if the archive type supports the compression level
+func ValidCompressionLevel(archiveType string, level int) bool {
+	levels, exists := compressionLevels[archiveType]
+
+	return !exists || level == DefaultCompressionLevel || (level >= levels.min && level <= levels.max)
+}
+
 // Helper struct for parsing the yaml
 type yamlUnit struct {
-	Sources          *[]string `yaml:"sources"`
-	Destination      *string   `yaml:"destination"`
-	Excludes         *[]string `yaml:"excludes"`
-	ArchiveType      *string   `yaml:"archive_type"`
-	AddSubfolder     *bool     `yaml:"add_subfolder"`
-	Enabled          *bool     `yaml:"enabled"`
-	UseAbsolutePaths *bool     `yaml:"use_absolute_paths"`
-	FollowSymlinks   *bool     `yaml:"follow_symlinks"`
+	Sources            *[]yamlSource `yaml:"sources"`
+	Destination        *string       `yaml:"destination"`
+	Excludes           *[]string     `yaml:"excludes"`
+	ArchiveType        *string       `yaml:"archive_type"`
+	AddSubfolder       *bool         `yaml:"add_subfolder"`
+	Enabled            *bool         `yaml:"enabled"`
+	UseAbsolutePaths   *bool         `yaml:"use_absolute_paths"`
+	FollowSymlinks     *bool         `yaml:"follow_symlinks"`
+	CompressionLevel   *int          `yaml:"compression_level"`
+	Workers            *int          `yaml:"workers"`
+	MemoryBudget       *string       `yaml:"memory_budget"`
+	ZipMethod          *string       `yaml:"zip_method"`
+	StoreExtensions    *[]string     `yaml:"store_extensions"`
+	VolumeSize         *string       `yaml:"volume_size"`
+	PreserveXattrs     *bool         `yaml:"preserve_xattrs"`
+	Directories        *string       `yaml:"directories"`
+	SpecialFiles       *string       `yaml:"special_files"`
+	Reproducible       *bool         `yaml:"reproducible"`
+	TarFormat          *string       `yaml:"tar_format"`
+	TimestampPrecision *string       `yaml:"timestamp_precision"`
+	EntryOrder         *string       `yaml:"entry_order"`
+	ManifestFile       *bool         `yaml:"manifest_file"`
+	PathMode           *string       `yaml:"path_mode"`
+	Seekable           *bool         `yaml:"seekable"`
+	RecoveryPercent    *int          `yaml:"recovery_percent"`
+	Encryption         *string       `yaml:"encryption"`
+	Recipients         *[]string     `yaml:"recipients"`
+	PassphraseFile     *string       `yaml:"passphrase_file"`
+	PassphraseEnv      *string       `yaml:"passphrase_env"`
+}
+
+// yamlSource is a source, which is either given as plain path or as map with path and archive_prefix
+type yamlSource struct {
+	Path          string `yaml:"path"`
+	ArchivePrefix string `yaml:"archive_prefix"`
 }
 
+func (source *yamlSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&source.Path); err == nil {
+		return nil
+	}
+
+	type plainSource yamlSource
+
+	return unmarshal((*plainSource)(source))
+}
+
+// StdoutDestination is the destination which makes backmeup stream the archive to stdout
+const StdoutDestination = "-"
+
+// defaultMemoryBudget is the amount of memory used for buffering compressed entries, if not configured otherwise
+const defaultMemoryBudget = 256 << 20
+
+// zipMethods contains the valid values for the zip_method option
+var zipMethods = []string{"store", "deflate", "zstd"}
+
+// directoryModes contains the valid values for the directories option
+var directoryModes = []string{"none", "empty", "all"}
+
+// specialFilePolicies contains the valid values for the special_files option
+var specialFilePolicies = []string{"skip", "header", "fail"}
+
+// tarFormats contains the valid values for the tar_format option
+var tarFormats = []string{"auto", "ustar", "pax", "gnu"}
+
+// timestampPrecisions contains the valid values for the timestamp_precision option
+var timestampPrecisions = []string{"second", "nanosecond"}
+
+// EntryOrders contains the valid values for the entry_order option
+var EntryOrders = []string{"walk", "path", "extension", "size"}
+
+// pathModes contains the valid values for the path_mode option
+var pathModes = []string{"absolute", "relative_to_source", "relative_to_parent"}
+
+// seekableArchiveTypes contains the archive types which support the seekable option
+var seekableArchiveTypes = []string{"tar.gz", "tar.zst"}
+
+// encryptionModes contains the valid values for the encryption option
+var encryptionModes = []string{"none", "age", "aes256"}
+
+// defaultStoreExtensions contains the extensions of already compressed file formats,
+// which are stored in zip archives without compressing them again
+var defaultStoreExtensions = []string{
+	"7z", "aac", "avi", "bz2", "docx", "flac", "gif", "gz", "heic", "jar", "jpeg", "jpg", "lz4", "m4a", "mkv",
+	"mov", "mp3", "mp4", "odt", "ogg", "png", "pptx", "rar", "tgz", "webm", "webp", "xlsx", "xz", "zip", "zst",
+}
+
+// DefaultCompressionLevel tells the compressors to use their respective default compression level
+const DefaultCompressionLevel = -1
+
 // FromYaml creates a config struct from a given yaml file as bytes
 func (config Config) FromYaml(yamlData []byte) (Config, error) {
 	unitMap := make(map[string]yamlUnit)
@@ -82,10 +220,135 @@ func (config Config) FromYaml(yamlData []byte) (Config, error) {
 			unit.FollowSymlinks = *yamlUnit.FollowSymlinks
 		}
 
+		unit.CompressionLevel = DefaultCompressionLevel
+		if yamlUnit.CompressionLevel != nil {
+			unit.CompressionLevel = *yamlUnit.CompressionLevel
+		}
+
+		// A worker count of 0 means that the global worker count is used
+		unit.Workers = 0
+		if yamlUnit.Workers != nil {
+			unit.Workers = *yamlUnit.Workers
+		}
+
+		unit.MemoryBudget = defaultMemoryBudget
+		if yamlUnit.MemoryBudget != nil {
+			memoryBudget, parseErr := parseSize(*yamlUnit.MemoryBudget)
+			if parseErr != nil {
+				log.Fatalf("Can't parse memory_budget of unit '%s': %v", unitName, parseErr)
+			}
+
+			unit.MemoryBudget = memoryBudget
+		}
+
+		unit.ZipMethod = "deflate"
+		if yamlUnit.ZipMethod != nil {
+			unit.ZipMethod = *yamlUnit.ZipMethod
+		}
+
+		unit.StoreExtensions = defaultStoreExtensions
+		if yamlUnit.StoreExtensions != nil {
+			unit.StoreExtensions = *yamlUnit.StoreExtensions
+		}
+
+		// A volume size of 0 means that the archive is not split into volumes
+		unit.VolumeSize = 0
+		if yamlUnit.VolumeSize != nil {
+			volumeSize, parseErr := parseSize(*yamlUnit.VolumeSize)
+			if parseErr != nil {
+				log.Fatalf("Can't parse volume_size of unit '%s': %v", unitName, parseErr)
+			}
+
+			unit.VolumeSize = volumeSize
+		}
+
+		unit.PreserveXattrs = false
+		if yamlUnit.PreserveXattrs != nil {
+			unit.PreserveXattrs = *yamlUnit.PreserveXattrs
+		}
+
+		unit.Directories = "none"
+		if yamlUnit.Directories != nil {
+			unit.Directories = *yamlUnit.Directories
+		}
+
+		unit.SpecialFiles = "skip"
+		if yamlUnit.SpecialFiles != nil {
+			unit.SpecialFiles = *yamlUnit.SpecialFiles
+		}
+
+		unit.Reproducible = false
+		if yamlUnit.Reproducible != nil {
+			unit.Reproducible = *yamlUnit.Reproducible
+		}
+
+		unit.TarFormat = "auto"
+		if yamlUnit.TarFormat != nil {
+			unit.TarFormat = *yamlUnit.TarFormat
+		}
+
+		unit.TimestampPrecision = "second"
+		if yamlUnit.TimestampPrecision != nil {
+			unit.TimestampPrecision = *yamlUnit.TimestampPrecision
+		}
+
+		unit.EntryOrder = "walk"
+		if yamlUnit.EntryOrder != nil {
+			unit.EntryOrder = *yamlUnit.EntryOrder
+		}
+
+		unit.ManifestFile = false
+		if yamlUnit.ManifestFile != nil {
+			unit.ManifestFile = *yamlUnit.ManifestFile
+		}
+
+		unit.Seekable = false
+		if yamlUnit.Seekable != nil {
+			unit.Seekable = *yamlUnit.Seekable
+		}
+
+		unit.RecoveryPercent = 0
+		if yamlUnit.RecoveryPercent != nil {
+			unit.RecoveryPercent = *yamlUnit.RecoveryPercent
+		}
+
+		unit.Encryption = "none"
+		if yamlUnit.Encryption != nil {
+			unit.Encryption = *yamlUnit.Encryption
+		}
+
+		if yamlUnit.Recipients != nil {
+			unit.Recipients = *yamlUnit.Recipients
+		}
+
+		if yamlUnit.PassphraseFile != nil {
+			unit.PassphraseFile = *yamlUnit.PassphraseFile
+		}
+
+		if yamlUnit.PassphraseEnv != nil {
+			unit.PassphraseEnv = *yamlUnit.PassphraseEnv
+		}
+
+		// use_absolute_paths is kept for existing configs, path_mode takes precedence
+		unit.PathMode = "relative_to_parent"
+		if yamlUnit.PathMode != nil {
+			unit.PathMode = *yamlUnit.PathMode
+		} else if unit.UseAbsolutePaths {
+			unit.PathMode = "absolute"
+		}
+
 		if yamlUnit.Sources == nil || yamlUnit.Destination == nil {
 			log.Fatalf("Sources or destination can't be parsed for unit '%s'", unitName)
 		} else {
-			unit.Sources = *yamlUnit.Sources
+			unit.ArchivePrefixes = make(map[string]string)
+
+			for _, source := range *yamlUnit.Sources {
+				unit.Sources = append(unit.Sources, source.Path)
+
+				if source.ArchivePrefix != "" {
+					unit.ArchivePrefixes[filepath.Clean(source.Path)] = source.ArchivePrefix
+				}
+			}
 			unit.Destination = *yamlUnit.Destination
 		}
 
@@ -97,6 +360,146 @@ func (config Config) FromYaml(yamlData []byte) (Config, error) {
 	return config, nil
 }
 
+// sizeUnits maps the suffixes of human-readable sizes to their multiplier
+var sizeUnits = map[string]int64{
+	"":  1,
+	"B": 1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseSize parses a human-readable size such as "512M" or "4GiB" into bytes
+func parseSize(size string) (int64, error) {
+	normalized := strings.ToUpper(strings.TrimSpace(size))
+	normalized = strings.TrimSuffix(strings.TrimSuffix(normalized, "IB"), "B")
+
+	numberEnd := strings.IndexFunc(normalized, func(r rune) bool { return r < '0' || r > '9' })
+	if numberEnd == -1 {
+		numberEnd = len(normalized)
+	}
+
+	number, err := strconv.ParseInt(normalized[:numberEnd], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+
+	multiplier, exists := sizeUnits[strings.TrimSpace(normalized[numberEnd:])]
+	if !exists || number <= 0 {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+
+	return number * multiplier, nil
+}
+
+// validateEncryption checks that a unit encrypted with age has either recipients or exactly one passphrase source
+// and that AES encryption is only used for zip archives
+func validateEncryption(unit Unit) error {
+	if !isInList(unit.Encryption, encryptionModes) {
+		log.Printf("The encryption '%s' of unit '%s' is not supported! Valid values: %s", unit.Encryption, unit.Name, strings.Join(encryptionModes, ", "))
+
+		return bkperrors.ErrInvalidOption
+	}
+
+	if unit.Encryption == "none" {
+		return nil
+	}
+
+	if unit.Encryption == "aes256" {
+		return validateZipEncryption(unit)
+	}
+
+	keySources := 0
+	for _, isSet := range []bool{len(unit.Recipients) > 0, unit.PassphraseFile != "", unit.PassphraseEnv != ""} {
+		if isSet {
+			keySources++
+		}
+	}
+
+	// A passphrase can't be combined with other recipients in age
+	if keySources != 1 {
+		log.Printf("Unit '%s' must have either recipients, a passphrase_file or a passphrase_env for encryption!", unit.Name)
+
+		return bkperrors.ErrInvalidOption
+	}
+
+	for _, recipient := range unit.Recipients {
+		if _, err := age.ParseX25519Recipient(recipient); err != nil {
+			log.Printf("The recipient '%s' of unit '%s' is invalid! %s", recipient, unit.Name, err)
+
+			return bkperrors.ErrInvalidOption
+		}
+	}
+
+	if unit.ArchiveType == "mirror" || unit.Seekable {
+		log.Printf("Mirror snapshots and seekable archives of unit '%s' can't be encrypted!", unit.Name)
+
+		return bkperrors.ErrInvalidOption
+	}
+
+	return nil
+}
+
+// validateZipEncryption checks that an AES encrypted unit is a zip archive with at most one password source.
+// Without passphrase_file and passphrase_env, the password is entered on the terminal.
+func validateZipEncryption(unit Unit) error {
+	if unit.ArchiveType != "zip" {
+		log.Printf("The encryption 'aes256' of unit '%s' is only supported for zip archives!", unit.Name)
+
+		return bkperrors.ErrInvalidOption
+	}
+
+	if len(unit.Recipients) > 0 {
+		log.Printf("Unit '%s' can't use recipients with the encryption 'aes256'!", unit.Name)
+
+		return bkperrors.ErrInvalidOption
+	}
+
+	if unit.PassphraseFile != "" && unit.PassphraseEnv != "" {
+		log.Printf("Unit '%s' can't have both a passphrase_file and a passphrase_env!", unit.Name)
+
+		return bkperrors.ErrInvalidOption
+	}
+
+	return nil
+}
+
+// validateArchivePrefixes cleans the archive prefixes of a unit and checks that they stay within the archive
+func validateArchivePrefixes(unit Unit) error {
+	for sourcePath, prefix := range unit.ArchivePrefixes {
+		cleaned := filepath.Clean(prefix)
+		slashed := filepath.ToSlash(cleaned)
+
+		if filepath.IsAbs(cleaned) || filepath.VolumeName(cleaned) != "" || strings.HasPrefix(slashed, "/") {
+			log.Printf("The archive prefix '%s' of unit '%s' must not be absolute!", prefix, unit.Name)
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if slashed == ".." || strings.HasPrefix(slashed, "../") {
+			log.Printf("The archive prefix '%s' of unit '%s' must not point outside of the archive!", prefix, unit.Name)
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		unit.ArchivePrefixes[sourcePath] = cleaned
+	}
+
+	return nil
+}
+
+// isInList checks if a string is contained in a given string slice
+func isInList(value string, list []string) bool {
+	for _, element := range list {
+		if value == element {
+			return true
+		}
+	}
+
+	return false
+}
+
 // validatePath checks if a given file/directory exists
 // It returns true if it exists, otherwise false
 func validatePath(path string, mustBeDir bool) bool {
@@ -128,6 +531,106 @@ func (config *Config) validate() error {
 			continue
 		}
 
+		if !archiveTypes[unit.ArchiveType] {
+			log.Printf("The given archive type ('%s') of unit '%s' is not supported!", unit.ArchiveType, unit.Name)
+
+			return bkperrors.ErrUnknownArchiveType
+		}
+
+		if !ValidCompressionLevel(unit.ArchiveType, unit.CompressionLevel) {
+			levels := compressionLevels[unit.ArchiveType]
+			log.Printf("The compression level %d of unit '%s' is not supported by archive type '%s'! Valid levels: %d-%d", unit.CompressionLevel, unit.Name, unit.ArchiveType, levels.min, levels.max)
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if unit.Workers < 0 {
+			log.Printf("The worker count of unit '%s' must not be negative!", unit.Name)
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if !isInList(unit.ZipMethod, zipMethods) {
+			log.Printf("The zip method '%s' of unit '%s' is not supported! Valid methods: %s", unit.ZipMethod, unit.Name, strings.Join(zipMethods, ", "))
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if !isInList(unit.Directories, directoryModes) {
+			log.Printf("The directories mode '%s' of unit '%s' is not supported! Valid modes: %s", unit.Directories, unit.Name, strings.Join(directoryModes, ", "))
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if !isInList(unit.SpecialFiles, specialFilePolicies) {
+			log.Printf("The special files policy '%s' of unit '%s' is not supported! Valid policies: %s", unit.SpecialFiles, unit.Name, strings.Join(specialFilePolicies, ", "))
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if !isInList(unit.TarFormat, tarFormats) {
+			log.Printf("The tar format '%s' of unit '%s' is not supported! Valid formats: %s", unit.TarFormat, unit.Name, strings.Join(tarFormats, ", "))
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if !isInList(unit.TimestampPrecision, timestampPrecisions) {
+			log.Printf("The timestamp precision '%s' of unit '%s' is not supported! Valid values: %s", unit.TimestampPrecision, unit.Name, strings.Join(timestampPrecisions, ", "))
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		// Only PAX headers can hold sub-second timestamps
+		if unit.TimestampPrecision == "nanosecond" && unit.TarFormat != "pax" {
+			log.Printf("Nanosecond timestamps of unit '%s' require tar_format 'pax'!", unit.Name)
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if !isInList(unit.EntryOrder, EntryOrders) {
+			log.Printf("The entry order '%s' of unit '%s' is not supported! Valid orders: %s", unit.EntryOrder, unit.Name, strings.Join(EntryOrders, ", "))
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if !isInList(unit.PathMode, pathModes) {
+			log.Printf("The path mode '%s' of unit '%s' is not supported! Valid modes: %s", unit.PathMode, unit.Name, strings.Join(pathModes, ", "))
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if unit.Seekable && !isInList(unit.ArchiveType, seekableArchiveTypes) {
+			log.Printf("Unit '%s' can't be seekable, only %s archives are supported!", unit.Name, strings.Join(seekableArchiveTypes, " and "))
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if unit.Seekable && unit.Destination == StdoutDestination {
+			log.Printf("Unit '%s' can't be seekable while streaming to stdout, because the seek index is written next to the archive!", unit.Name)
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if unit.RecoveryPercent < 0 || unit.RecoveryPercent > 100 {
+			log.Printf("The recovery percentage %d of unit '%s' is invalid! Valid values: 0-100", unit.RecoveryPercent, unit.Name)
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if unit.RecoveryPercent > 0 && (unit.Destination == StdoutDestination || unit.ArchiveType == "mirror") {
+			log.Printf("No recovery file can be created for unit '%s' while streaming to stdout or for mirror snapshots!", unit.Name)
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if err := validateEncryption(unit); err != nil {
+			return err
+		}
+
+		if err := validateArchivePrefixes(unit); err != nil {
+			return err
+		}
+
 		for _, sourcePath := range unit.Sources {
 			// Each source path must be an existing directory!
 			if !validatePath(sourcePath, false) {
@@ -136,8 +639,20 @@ func (config *Config) validate() error {
 				return bkperrors.ErrCannotAccessSrcDir
 			}
 		}
+		if unit.ArchiveType == "mirror" && (unit.Destination == StdoutDestination || unit.VolumeSize > 0) {
+			log.Printf("Mirror snapshots of unit '%s' can't be streamed to stdout or split into volumes!", unit.Name)
+
+			return bkperrors.ErrInvalidOption
+		}
+
+		if unit.Destination == StdoutDestination && unit.VolumeSize > 0 {
+			log.Printf("Unit '%s' can't be split into volumes while streaming to stdout!", unit.Name)
+
+			return bkperrors.ErrInvalidOption
+		}
+
 		// Also the destination path must exist!
-		if !validatePath(unit.Destination, true) {
+		if unit.Destination != StdoutDestination && !validatePath(unit.Destination, true) {
 			log.Printf("The given destination path ('%s') does not exist or is no directory!", unit.Destination)
 
 			return bkperrors.ErrCannotAccessDstDir
@@ -149,6 +664,15 @@ func (config *Config) validate() error {
 	return nil
 }
 
+// OverrideDestination replaces the destination of all units and validates the config again
+func (config *Config) OverrideDestination(destination string) error {
+	for i := range config.Units {
+		config.Units[i].Destination = destination
+	}
+
+	return config.validate()
+}
+
 // ReadConfig reads a config file from a given path
 func ReadConfig(configPath string) (Config, error) {
 	log.Printf("Trying to read config file '%s'!", configPath)
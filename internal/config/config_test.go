@@ -0,0 +1,134 @@
+package config
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/d-Rickyy-b/backmeup/internal/bkperrors"
+)
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]int64{
+		"100":    100,
+		"512B":   512,
+		"4K":     4 << 10,
+		"256M":   256 << 20,
+		"4GiB":   4 << 30,
+		"2 GB":   2 << 30,
+		"1t":     1 << 40,
+		" 64mb ": 64 << 20,
+	}
+
+	for size, expected := range sizes {
+		parsed, err := parseSize(size)
+		if err != nil {
+			t.Fatalf("Size '%s' could not be parsed: %v", size, err)
+		}
+
+		if parsed != expected {
+			t.Fatalf("Size '%s' was parsed as %d instead of %d", size, parsed, expected)
+		}
+	}
+}
+
+func TestParseSizeInvalid(t *testing.T) {
+	sizes := []string{"", "M", "-5M", "0", "12X", "1.5G"}
+
+	for _, size := range sizes {
+		if _, err := parseSize(size); err == nil {
+			t.Fatalf("Invalid size '%s' was parsed without error", size)
+		}
+	}
+}
+
+func TestFromYamlSources(t *testing.T) {
+	yamlData := []byte(`
+db:
+  sources:
+    - /home/user/documents
+    - path: /var/lib/postgresql/16/main
+      archive_prefix: postgres
+  destination: /backups
+  path_mode: relative_to_source
+`)
+
+	config, err := Config{}.FromYaml(yamlData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unit := config.Units[0]
+	if len(unit.Sources) != 2 || unit.Sources[0] != "/home/user/documents" || unit.Sources[1] != "/var/lib/postgresql/16/main" {
+		t.Fatalf("Sources were parsed as %v", unit.Sources)
+	}
+
+	if unit.ArchivePrefixes["/var/lib/postgresql/16/main"] != "postgres" || len(unit.ArchivePrefixes) != 1 {
+		t.Fatalf("Archive prefixes were parsed as %v", unit.ArchivePrefixes)
+	}
+
+	if unit.PathMode != "relative_to_source" {
+		t.Fatalf("Path mode was parsed as '%s'", unit.PathMode)
+	}
+}
+
+// prefixConfig returns a valid config with a single source, which is stored with the given archive prefix
+func prefixConfig(t *testing.T, prefix string) Config {
+	t.Helper()
+
+	yamlData := []byte(`
+db:
+  sources:
+    - path: ` + t.TempDir() + `
+      archive_prefix: ` + prefix + `
+  destination: ` + t.TempDir() + `
+`)
+
+	config, err := Config{}.FromYaml(yamlData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Archive types are registered by the archiver package, which is not imported here
+	RegisterArchiveType(config.Units[0].ArchiveType)
+
+	return config
+}
+
+func TestValidateArchivePrefix(t *testing.T) {
+	prefixes := map[string]string{
+		"postgres":          "postgres",
+		"./db/postgres/":    "db/postgres",
+		"db//../postgres":   "postgres",
+		"db/postgres/../..": ".",
+	}
+
+	for prefix, expected := range prefixes {
+		config := prefixConfig(t, prefix)
+		if err := config.validate(); err != nil {
+			t.Fatalf("Archive prefix '%s' is invalid: %v", prefix, err)
+		}
+
+		unit := config.Units[0]
+		if cleaned := unit.ArchivePrefixes[unit.Sources[0]]; cleaned != expected {
+			t.Fatalf("Archive prefix '%s' was cleaned to '%s' instead of '%s'", prefix, cleaned, expected)
+		}
+	}
+}
+
+func TestValidateArchivePrefixAbsolute(t *testing.T) {
+	for _, prefix := range []string{"/postgres", "/"} {
+		config := prefixConfig(t, prefix)
+		if err := config.validate(); !errors.Is(err, bkperrors.ErrInvalidOption) {
+			t.Fatalf("Absolute archive prefix '%s' was validated with %v", prefix, err)
+		}
+	}
+}
+
+func TestValidateArchivePrefixOutside(t *testing.T) {
+	for _, prefix := range []string{"..", "../postgres", "db/../../postgres"} {
+		config := prefixConfig(t, prefix)
+		if err := config.validate(); !errors.Is(err, bkperrors.ErrInvalidOption) {
+			t.Fatalf("Archive prefix '%s' outside of the archive was validated with %v", prefix, err)
+		}
+	}
+}